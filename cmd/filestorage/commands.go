@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/hungaikev/rdiff/internal/pkg/apply"
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/librsync"
+	"github.com/hungaikev/rdiff/internal/pkg/rolling"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
+	"github.com/hungaikev/rdiff/internal/pkg/vcdiff"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store"
+	"github.com/hungaikev/rdiff/internal/store/disk"
+	"github.com/hungaikev/rdiff/internal/store/sqlite"
+)
+
+// usage describes the commands of the program
+const usage = `Usage:
+  rdiff [OPTIONS] signature [BASIS [SIGNATURE]]
+  rdiff [OPTIONS] delta SIGNATURE [NEWFILE [DELTA]]
+  rdiff [OPTIONS] patch BASIS [DELTA [NEWFILE]]
+  rdiff [OPTIONS] gc
+
+Omitted files and "-" mean stdin or stdout. The basis of patch must be a regular file.
+Signature files use the librsync format. Deltas are written in the librsync or the VCDIFF
+format, patch detects the format of the delta it reads.
+
+gc removes the versions of the stored files the retention options do not keep, and the
+content only they referenced. The latest version of a file is always kept.`
+
+// stdio is the file name that stands for stdin or stdout
+const stdio = "-"
+
+// Delta formats
+const (
+	formatLibrsync = "librsync"
+	formatVCDIFF   = "vcdiff"
+)
+
+// Storage backends
+const (
+	backendBolt   = "bolt"
+	backendSQLite = "sqlite"
+)
+
+// command runs the commands of the program
+type command struct {
+	log        *zerolog.Logger
+	tracer     trace.Tracer
+	weakHash   string
+	strongHash string
+	strongLen  int
+	blockSize  int
+	format     string
+	checksum   string
+	backend    string
+	storePath  string
+	keepLast   int
+	keepWithin time.Duration
+	keepTagged bool
+	dryRun     bool
+}
+
+// signature writes the signature of the basis file
+func (c *command) signature(ctx context.Context, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("signature takes at most 2 arguments, see --help")
+	}
+
+	weakHash, err := rolling.Parse(c.weakHash)
+	if err != nil {
+		return err
+	}
+
+	strongHash, err := strong.Parse(c.strongHash)
+	if err != nil {
+		return err
+	}
+
+	basis, err := openInput(arg(args, 0))
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	sig, err := signature.Generate(ctx, basis, c.log, signature.WithWeakHash(weakHash), signature.WithStrongHash(strongHash, c.strongLen), signature.WithBlockSize(c.blockSize))
+	if err != nil {
+		return fmt.Errorf("error generating signature: %w", err)
+	}
+
+	return writeOutput(arg(args, 1), func(w io.Writer) error {
+		return librsync.EncodeSignature(w, sig)
+	})
+}
+
+// delta writes the delta that turns the file described by the signature into the new file
+func (c *command) delta(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("delta takes between 1 and 3 arguments, see --help")
+	}
+	if c.format != formatLibrsync && c.format != formatVCDIFF {
+		return fmt.Errorf("unknown delta format %q: expected %s or %s", c.format, formatLibrsync, formatVCDIFF)
+	}
+	if arg(args, 0) == stdio && arg(args, 1) == stdio {
+		return fmt.Errorf("signature and new file can not both be read from stdin")
+	}
+
+	sigFile, err := openInput(arg(args, 0))
+	if err != nil {
+		return err
+	}
+	defer sigFile.Close()
+
+	sig, err := librsync.DecodeSignature(sigFile)
+	if err != nil {
+		return fmt.Errorf("error reading signature: %w", err)
+	}
+
+	newFile, err := openInput(arg(args, 1))
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+
+	// the instructions are written as the new file is read, the delta is never held in memory
+	return writeOutput(arg(args, 2), func(w io.Writer) error {
+		var ow deltaWriter = librsync.NewDeltaWriter(w)
+		if c.format == formatVCDIFF {
+			ow = vcdiff.NewWriter(w)
+		}
+
+		summary, err := diff.Stream(ctx, sig, newFile, ow)
+		if err != nil {
+			return fmt.Errorf("error computing delta: %w", err)
+		}
+		if err := ow.Flush(); err != nil {
+			return fmt.Errorf("error writing delta: %w", err)
+		}
+
+		c.log.Info().Msgf("computed delta: %d instructions, %d literal bytes, new file checksum %x", summary.Ops, summary.LiteralBytes, summary.Checksum)
+		return nil
+	})
+}
+
+// deltaWriter writes delta instructions in one of the delta formats
+type deltaWriter interface {
+	diff.OpWriter
+	Flush() error
+}
+
+// patch applies the delta to the basis file and writes the new file
+func (c *command) patch(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("patch takes between 1 and 3 arguments, see --help")
+	}
+	if arg(args, 0) == stdio {
+		return fmt.Errorf("the basis file must be a regular file, not stdin")
+	}
+
+	basis, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("error opening basis file: %w", err)
+	}
+	defer basis.Close()
+
+	deltaFile, err := openInput(arg(args, 1))
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	var options []apply.PatchOption
+	if c.checksum != "" {
+		checksum, err := hex.DecodeString(c.checksum)
+		if err != nil || len(checksum) != sha256.Size {
+			return fmt.Errorf("invalid checksum %q: expected %d hex encoded bytes", c.checksum, sha256.Size)
+		}
+		options = append(options, apply.WithChecksum(checksum))
+	}
+
+	return writeOutput(arg(args, 2), func(w io.Writer) error {
+		_, err := apply.Patch(ctx, basis, deltaFile, w, options...)
+		return err
+	})
+}
+
+// gc removes the versions the retention policy does not keep and the content only they referenced
+func (c *command) gc(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("gc takes no arguments, see --help")
+	}
+
+	storage, err := c.openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	policy := models.RetentionPolicy{KeepLast: c.keepLast, KeepTagged: c.keepTagged}
+	if c.keepWithin > 0 {
+		policy.KeepNewerThan = time.Now().Add(-c.keepWithin)
+	}
+
+	report, err := storage.GC(ctx, policy, c.dryRun)
+	if err != nil {
+		return err
+	}
+	report.Print()
+	return nil
+}
+
+// closableStorage is a storage backend holding a database open
+type closableStorage interface {
+	store.Storage
+	io.Closer
+}
+
+// openStorage opens the database of the configured storage backend
+func (c *command) openStorage(ctx context.Context) (closableStorage, error) {
+	switch c.backend {
+	case backendBolt:
+		return disk.Open(c.storePath, c.log, c.tracer)
+	case backendSQLite:
+		return sqlite.Open(ctx, c.storePath, c.log, c.tracer)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q: expected %s or %s", c.backend, backendBolt, backendSQLite)
+	}
+}
+
+// arg returns the i'th argument, or stdio when it is omitted
+func arg(args []string, i int) string {
+	if i >= len(args) {
+		return stdio
+	}
+	return args[i]
+}
+
+// openInput opens the named file for reading, or stdin
+func openInput(name string) (*os.File, error) {
+	if name == stdio {
+		return os.Stdin, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+	return file, nil
+}
+
+// writeOutput creates the named file, or uses stdout, and passes it to write.
+// A partially written file is removed if write fails.
+func writeOutput(name string, write func(w io.Writer) error) error {
+	if name == stdio {
+		return write(os.Stdout)
+	}
+
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(name)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing output file: %w", err)
+	}
+	return nil
+}
@@ -4,17 +4,13 @@ import (
 	"context"
 	"expvar"
 	"fmt"
+	"os"
+	"time"
+
 	"github.com/ardanlabs/conf/v3"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel"
-	"math/rand"
-	"os"
-	"time"
-
-	"github.com/hungaikev/rdiff/internal/logic"
-	"github.com/hungaikev/rdiff/internal/pkg/fileio"
-	"github.com/hungaikev/rdiff/internal/store/memory"
 )
 
 const (
@@ -22,8 +18,6 @@ const (
 	LogStrKeyModule = "module"
 	// LogStrKeyService is for use with the logger as a key to specify the service name.
 	LogStrKeyService = "service"
-
-	filePath = "cmd/filestorage/files/test.txt"
 )
 
 // build is the git version of this program. It is set using build flags in the makefile.
@@ -49,6 +43,29 @@ func run(log *zerolog.Logger) error {
 
 	var cfg struct {
 		conf.Version
+		Args      conf.Args
+		Signature struct {
+			WeakHash   string `conf:"default:rabinkarp,help:rolling checksum of the blocks: rabinkarp or adler32"`
+			StrongHash string `conf:"default:blake2b,help:strong digest of the blocks: blake2b or md4"`
+			StrongLen  int    `conf:"default:0,help:length in bytes the strong digests are truncated to (0 keeps the full digest)"`
+			BlockSize  int    `conf:"default:0,help:size in bytes of the blocks (0 picks it from the size of the basis file)"`
+		}
+		Patch struct {
+			Checksum string `conf:"help:expected SHA-256 digest of the new file in hex; patch fails if the output does not match"`
+		}
+		Delta struct {
+			Format string `conf:"default:librsync,help:format of the deltas written by the delta command: librsync or vcdiff"`
+		}
+		Store struct {
+			Backend string `conf:"default:sqlite,help:storage backend holding the versions of the files: bolt or sqlite"`
+			Path    string `conf:"default:rdiff.db,help:path of the database of the storage backend"`
+		}
+		GC struct {
+			KeepLast   int           `conf:"default:10,help:number of latest versions of each file kept by gc"`
+			KeepWithin time.Duration `conf:"default:0s,help:versions created within this duration are kept by gc (0 keeps none)"`
+			KeepTagged bool          `conf:"default:true,help:tagged versions are kept by gc"`
+			DryRun     bool          `conf:"default:false,help:gc reports what it would remove without removing anything"`
+		}
 	}
 	cfg.Version.Build = build
 	cfg.Version.Desc = "Hungai' Interview Solution"
@@ -60,10 +77,11 @@ func run(log *zerolog.Logger) error {
 	log.Info().Msgf("Started: Application initializing: version %q", build)
 	defer log.Info().Msg("Completed")
 
-	help, err := conf.Parse("", &cfg)
+	help, err := conf.Parse("RDIFF", &cfg)
 	if err != nil {
 		if errors.Is(err, conf.ErrHelpWanted) {
-			log.Info().Msg(help)
+			fmt.Fprintln(os.Stderr, usage)
+			fmt.Fprintln(os.Stderr, help)
 			return nil
 		}
 		return fmt.Errorf("parsing config: %w", err)
@@ -80,74 +98,44 @@ func run(log *zerolog.Logger) error {
 
 	var tracer = otel.Tracer("main")
 
-	// =========================================================================
-	// Storage
-
-	storage := memory.New(log, tracer)
-
-	// =========================================================================
-	// Logic
-
-	rdiffLogic := logic.New(log, storage, tracer)
+	ctx, span := tracer.Start(context.Background(), "main.run")
+	defer span.End()
 
 	// =========================================================================
-	// Open File
-
-	ctx := context.Background()
-
-	log.Info().Msg("Opening file...")
-
-	file, err := fileio.OpenFile(ctx, filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
+	// Commands
+
+	cmd := command{
+		log:        log,
+		weakHash:   cfg.Signature.WeakHash,
+		strongHash: cfg.Signature.StrongHash,
+		strongLen:  cfg.Signature.StrongLen,
+		blockSize:  cfg.Signature.BlockSize,
+		format:     cfg.Delta.Format,
+		checksum:   cfg.Patch.Checksum,
+		tracer:     tracer,
+		backend:    cfg.Store.Backend,
+		storePath:  cfg.Store.Path,
+		keepLast:   cfg.GC.KeepLast,
+		keepWithin: cfg.GC.KeepWithin,
+		keepTagged: cfg.GC.KeepTagged,
+		dryRun:     cfg.GC.DryRun,
 	}
 
-	defer file.Close()
-
-	// =========================================================================
-	// Handle File
-	_, err = rdiffLogic.Handle(ctx, file)
-	if err != nil {
-		return fmt.Errorf("error handling file: %w", err)
-	}
-
-	// =========================================================================
-
-	log.Info().Msgf("File %s has been processed successfully", filePath)
-
-	// =========================================================================
-
-	log.Info().Msgf("Writing to file %s", filePath)
-
-	if err := fileio.WriteToFile(ctx, filePath, generateRandomString(100)); err != nil {
-		return fmt.Errorf("error writing to file: %w", err)
-	}
-
-	file2, err := fileio.OpenFile(ctx, filePath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %w", err)
-	}
-
-	defer file2.Close()
-
-	_, err = rdiffLogic.Handle(ctx, file2)
-	if err != nil {
-		return fmt.Errorf("error handling file 2: %w", err)
+	args := cfg.Args
+	if len(args) == 0 {
+		return fmt.Errorf("missing command: expected signature, delta, patch or gc")
 	}
 
-	return nil
-}
-
-func generateRandomString(length int) string {
-	// Seed the random number generator
-	rand.Seed(time.Now().UnixNano())
-	// Define a set of characters to use in the random string
-	charSet := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	// Create an empty slice of bytes with the specified length
-	bytes := make([]byte, length)
-	// Fill the slice with random characters
-	for i := range bytes {
-		bytes[i] = charSet[rand.Intn(len(charSet))]
+	switch args[0] {
+	case "signature":
+		return cmd.signature(ctx, args[1:])
+	case "delta":
+		return cmd.delta(ctx, args[1:])
+	case "patch":
+		return cmd.patch(ctx, args[1:])
+	case "gc":
+		return cmd.gc(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q: expected signature, delta, patch or gc", args[0])
 	}
-	return string(bytes)
 }
@@ -4,6 +4,7 @@ package logic
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -16,20 +17,43 @@ import (
 	"github.com/hungaikev/rdiff/internal/store"
 )
 
+// DefaultKeyframeInterval is the number of versions between two full snapshots of a file
+const DefaultKeyframeInterval = models.DefaultKeyframeInterval
+
 // Logic defines the business logic for application related operations within this library
 type Logic struct {
-	log     *zerolog.Logger
-	storage store.Storage
-	tracer  trace.Tracer
+	log      *zerolog.Logger
+	storage  store.Storage
+	tracer   trace.Tracer
+	keyframe int
+}
+
+// Option configures Logic
+type Option func(*Logic)
+
+// WithKeyframeInterval stores the full content of a file every k versions, starting with the
+// first one. Restoring a version applies at most k-1 deltas to the closest snapshot.
+func WithKeyframeInterval(k int) Option {
+	return func(l *Logic) {
+		l.keyframe = k
+	}
 }
 
 // New creates an instance of the Logic implementation
-func New(log *zerolog.Logger, storage store.Storage, tracer trace.Tracer) *Logic {
-	return &Logic{
-		log:     log,
-		storage: storage,
-		tracer:  tracer,
+func New(log *zerolog.Logger, storage store.Storage, tracer trace.Tracer, options ...Option) *Logic {
+	l := &Logic{
+		log:      log,
+		storage:  storage,
+		tracer:   tracer,
+		keyframe: DefaultKeyframeInterval,
+	}
+	for _, option := range options {
+		option(l)
 	}
+	if l.keyframe < 1 {
+		l.keyframe = 1
+	}
+	return l
 }
 
 // Handle handles the application logic for the given library
@@ -55,29 +79,22 @@ func (l *Logic) Handle(ctx context.Context, file *os.File) (*models.Delta, error
 			return nil, fmt.Errorf("error retrieving signature: %w", err)
 		}
 
-		// step 2.1 generate the signature of the updated file.
-		updated, err := signature.Generate(ctx, file, l.log)
-		if err != nil {
-			return nil, fmt.Errorf("error generating signature: %w", err)
-		}
-
-		// step 2.2: run the Diff method
-		delta, err = diff.Compare(ctx, original, updated)
+		// step 2.1: run the Diff method against the content of the updated file
+		delta, err = diff.Compare(ctx, original, file)
 		if err != nil {
 			return nil, fmt.Errorf("error running Diff: %w", err)
 		}
 
-		// instantiate a new apply
-		apply := apply.New(delta, l.storage, l.log, l.tracer)
+		l.log.Info().Msgf("computed delta for file %s: %d instructions, %d literal bytes", file.Name(), len(delta.Ops), delta.LiteralBytes())
 
-		// step 2.3: run apply to synchronize the files
-		newSig, err := apply.Changes(ctx, original)
-		if err != nil {
-			return nil, fmt.Errorf("error applying changes: %w", err)
+		// step 2.2: the file on disk already holds the updated content, the new version is
+		// recorded like apply records the versions it writes. The previous content is gone,
+		// the version has no reverse delta, see Rollback.
+		a := apply.New(delta, l.storage, l.log, l.tracer, apply.WithKeyframeInterval(l.keyframe))
+		if _, err := a.Record(ctx, original, nil); err != nil {
+			return nil, fmt.Errorf("error recording version: %w", err)
 		}
 
-		original = newSig
-
 		return delta, nil
 
 	}
@@ -89,12 +106,15 @@ func (l *Logic) Handle(ctx context.Context, file *os.File) (*models.Delta, error
 	}
 	l.log.Info().Msgf("generated signature for file: %s", file.Name())
 
-	saved, err := l.storage.Save(ctx, updated)
-	if err != nil {
-		return nil, fmt.Errorf("error saving signature: %w", err)
+	// step 4: the first version is always a keyframe, the storage reads the content of the file
+	// as it stores it
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error rewinding file: %w", err)
 	}
 
-	original = saved
+	if _, err := l.storage.Save(ctx, &models.Version{Signature: updated, Content: file}); err != nil {
+		return nil, fmt.Errorf("error saving signature: %w", err)
+	}
 
 	return delta, nil
 }
@@ -0,0 +1,101 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hungaikev/rdiff/internal/pkg/apply"
+	"github.com/hungaikev/rdiff/internal/pkg/fileio"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Restore writes version n of the given file to w. It starts from the closest snapshot at or
+// before version n and applies the deltas of the following versions, composed into one delta
+// so the intermediate versions are never rebuilt. Only the content of that one snapshot is
+// read. The result is verified against the length and checksum of the last delta.
+func (l *Logic) Restore(ctx context.Context, filename string, n int, w io.Writer) error {
+	ctx, span := l.tracer.Start(ctx, "logic.Restore")
+	defer span.End()
+
+	versions, err := l.storage.ListVersions(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("error listing versions: %w", err)
+	}
+	// versions removed by garbage collection leave gaps in the numbers
+	i := len(versions) - 1
+	for i >= 0 && versions[i].Number != n {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("version %d of file %s not found, %d versions stored", n, filename, len(versions))
+	}
+
+	// walk back to the closest keyframe
+	k := i
+	for k >= 0 && !versions[k].IsKeyframe() {
+		if versions[k].Delta == nil {
+			return fmt.Errorf("version %d of file %s has neither a snapshot nor a delta", versions[k].Number, filename)
+		}
+		if k > 0 && versions[k-1].Number != versions[k].Number-1 {
+			return fmt.Errorf("version %d of file %s was removed, version %d can not be restored", versions[k].Number-1, filename, n)
+		}
+		k--
+	}
+	if k < 0 {
+		return fmt.Errorf("no snapshot found for version %d of file %s", n, filename)
+	}
+
+	// the versions are listed without the content of their snapshots
+	keyframe, err := l.storage.GetVersion(ctx, filename, versions[k].Number)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot of version %d: %w", versions[k].Number, err)
+	}
+	snapshot := keyframe.Snapshot
+	if k == i {
+		if _, err := w.Write(snapshot); err != nil {
+			return fmt.Errorf("error writing restored file: %w", err)
+		}
+		return nil
+	}
+
+	delta := versions[k+1].Delta
+	for _, v := range versions[k+2 : i+1] {
+		if delta, err = models.ComposeDeltas(delta, v.Delta); err != nil {
+			return fmt.Errorf("error composing delta of version %d: %w", v.Number, err)
+		}
+	}
+
+	if _, err := apply.Rebuild(ctx, bytes.NewReader(snapshot), delta, w); err != nil {
+		return fmt.Errorf("error rebuilding version %d from version %d: %w", n, versions[k].Number, err)
+	}
+
+	l.log.Info().Msgf("restored version %d of file %s from the snapshot of version %d and %d deltas", n, filename, versions[k].Number, i-k)
+	return nil
+}
+
+// RestoreFile writes version n of the given file to path, see Restore. The file at path is only
+// replaced once the version has been restored and verified.
+func (l *Logic) RestoreFile(ctx context.Context, filename string, n int, path string) error {
+	ctx, span := l.tracer.Start(ctx, "logic.RestoreFile")
+	defer span.End()
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	return fileio.WriteAtomic(ctx, path, perm, func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+		if err := l.Restore(ctx, filename, n, bw); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("error writing restored file: %w", err)
+		}
+		return nil
+	})
+}
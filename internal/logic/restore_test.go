@@ -0,0 +1,109 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/memory"
+)
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	tracer := otel.Tracer("tests")
+
+	storage := memory.New(&log, tracer)
+	l := New(&log, storage, tracer, WithKeyframeInterval(3))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+
+	// every version edits, grows or shrinks the previous one
+	var contents [][]byte
+	content := bytes.Repeat([]byte("line of text\n"), 2000)
+	for i := 0; i < 7; i++ {
+		switch i % 3 {
+		case 1:
+			content = append(append([]byte(nil), content[:1000]...), content[5000:]...)
+		case 2:
+			content = append(append([]byte(nil), content...), fmt.Sprintf("appended in version %d\n", i+1)...)
+		default:
+			content = append([]byte(fmt.Sprintf("version %d\n", i+1)), content...)
+		}
+		contents = append(contents, content)
+
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = l.Handle(ctx, file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	versions, err := storage.ListVersions(ctx, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, v := range versions {
+		if keyframe := (v.Number-1)%3 == 0; keyframe != v.IsKeyframe() {
+			t.Errorf("unexpected snapshot of version %d", v.Number)
+		}
+	}
+
+	for n, want := range contents {
+		var got bytes.Buffer
+		if err := l.Restore(ctx, path, n+1, &got); err != nil {
+			t.Errorf("version %d: unexpected error: %v", n+1, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("version %d: restored content does not match", n+1)
+		}
+	}
+
+	restored := filepath.Join(dir, "restored.txt")
+	if err := l.RestoreFile(ctx, path, 2, restored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := os.ReadFile(restored); !bytes.Equal(b, contents[1]) {
+		t.Errorf("restored file does not match version 2")
+	}
+
+	for _, n := range []int{0, len(contents) + 1} {
+		if err := l.Restore(ctx, path, n, &bytes.Buffer{}); err == nil {
+			t.Errorf("expected an error for version %d", n)
+		}
+	}
+
+	// versions 6 and 7 are restored from the snapshot of version 4, the older ones are removed
+	if _, err := storage.GC(ctx, models.RetentionPolicy{KeepLast: 2}, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for n, want := range contents {
+		var got bytes.Buffer
+		err := l.Restore(ctx, path, n+1, &got)
+		if n+1 < 4 {
+			if err == nil {
+				t.Errorf("version %d: expected an error for a removed version", n+1)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("version %d: restored content does not match after the collection: %v", n+1, err)
+		}
+	}
+}
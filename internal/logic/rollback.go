@@ -0,0 +1,126 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hungaikev/rdiff/internal/pkg/apply"
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/fileio"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Rollback brings the given file back to its previous version. The reverse delta of the latest
+// version is applied to the file when it has one, as versions recorded by apply.Changes do;
+// otherwise the previous version is restored from storage. It fails when the file no longer
+// matches its latest version, and the file is only replaced once the previous version has
+// been rebuilt and verified. The previous content is recorded as a new version, so a rollback
+// can itself be rolled back.
+func (l *Logic) Rollback(ctx context.Context, filename string) (*models.Version, error) {
+	ctx, span := l.tracer.Start(ctx, "logic.Rollback")
+	defer span.End()
+
+	versions, err := l.storage.ListVersions(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions: %w", err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("file %s has no versions", filename)
+	}
+	latest := versions[len(versions)-1]
+	if latest.Delta == nil {
+		return nil, fmt.Errorf("version %d of file %s has no previous version, it can not be rolled back", latest.Number, filename)
+	}
+
+	current, err := l.storage.GetSignatureForFilename(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving signature: %w", err)
+	}
+	// a delta may not read every byte of the file, its output would match its checksum anyway
+	if err := verify(ctx, filename, current); err != nil {
+		return nil, err
+	}
+
+	// the reverse delta of the latest version is the delta of the new one
+	delta := latest.Reverse
+	if delta != nil {
+		err = l.rebuild(ctx, filename, delta)
+	} else {
+		err = l.RestoreFile(ctx, filename, latest.Number-1, filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if delta == nil {
+		file, err := fileio.OpenFile(ctx, filename)
+		if err != nil {
+			return nil, fmt.Errorf("error opening rolled back file: %w", err)
+		}
+		delta, err = diff.Compare(ctx, current, file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error running Diff: %w", err)
+		}
+	}
+
+	// the delta of the latest version is the reverse delta of the new one
+	a := apply.New(delta, l.storage, l.log, l.tracer, apply.WithKeyframeInterval(l.keyframe))
+	version, err := a.Record(ctx, current, latest.Delta)
+	if err != nil {
+		return nil, fmt.Errorf("error recording version: %w", err)
+	}
+
+	l.log.Info().Msgf("rolled back file %s from version %d, recorded as version %d", filename, latest.Number, version.Number)
+	return version, nil
+}
+
+// verify checks that the file at path is the one the signature describes
+func verify(ctx context.Context, path string, sig *models.Signature) error {
+	file, err := fileio.OpenFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return fmt.Errorf("error reading file: %w", err)
+	}
+	if !bytes.Equal(checksum.Sum(nil), sig.Checksum) {
+		return fmt.Errorf("file %s has changed since its latest version", path)
+	}
+	return nil
+}
+
+// rebuild replaces the file at path with the result of the delta applied to it
+func (l *Logic) rebuild(ctx context.Context, path string, delta *models.Delta) error {
+	original, err := fileio.OpenFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %w", err)
+	}
+	defer original.Close()
+
+	info, err := original.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file information: %w", err)
+	}
+
+	return fileio.WriteAtomic(ctx, path, info.Mode().Perm(), func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+
+		// Rebuild verifies the length and the checksum of the output
+		if _, err := apply.Rebuild(ctx, original, delta, bw); err != nil {
+			return fmt.Errorf("error rebuilding file: %w", err)
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,100 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/store/memory"
+)
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	tracer := otel.Tracer("tests")
+
+	storage := memory.New(&log, tracer)
+	l := New(&log, storage, tracer, WithKeyframeInterval(2))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+
+	handle := func(content []byte) {
+		t.Helper()
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer file.Close()
+		if _, err := l.Handle(ctx, file); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	v1 := bytes.Repeat([]byte("line of text\n"), 1000)
+	v2 := append([]byte("inserted line\n"), v1[:8000]...)
+	v3 := append(append([]byte(nil), v2...), "appended line\n"...)
+	handle(v1)
+
+	// the first version has nothing to go back to
+	if _, err := l.Rollback(ctx, path); err == nil {
+		t.Errorf("expected an error rolling back the first version")
+	}
+
+	handle(v2)
+	handle(v3)
+
+	// the previous content of a file changed on disk is gone, the version is rolled back
+	// from the restored previous version
+	version, err := l.Rollback(ctx, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, v2) {
+		t.Errorf("file was not rolled back to version 2")
+	}
+	if version.Number != 4 || version.Signature.FileSize != int64(len(v2)) {
+		t.Errorf("unexpected version: %d, %d bytes", version.Number, version.Signature.FileSize)
+	}
+
+	// the rollback is recorded like any other version
+	var restored bytes.Buffer
+	if err := l.Restore(ctx, path, 4, &restored); err != nil || !bytes.Equal(restored.Bytes(), v2) {
+		t.Errorf("unexpected restored version 4: %v", err)
+	}
+
+	// rolling back the rollback applies its reverse delta, the delta of version 3
+	versions, err := storage.ListVersions(ctx, path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if versions[2].Reverse != nil || versions[3].Reverse == nil {
+		t.Errorf("unexpected reverse deltas of versions 3 and 4")
+	}
+	if _, err := l.Rollback(ctx, path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, v3) {
+		t.Errorf("file was not rolled back to version 3")
+	}
+
+	// a file changed since its latest version is left alone
+	changed := append(append([]byte(nil), v3...), "not recorded\n"...)
+	if err := os.WriteFile(path, changed, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := l.Rollback(ctx, path); err == nil {
+		t.Errorf("expected an error rolling back a changed file")
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, changed) {
+		t.Errorf("changed file was modified")
+	}
+}
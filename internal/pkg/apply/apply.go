@@ -2,94 +2,380 @@
 package apply
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
-	"github.com/hungaikev/rdiff/internal/pkg/fileio"
+	"io"
+	"os"
+
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
-	"golang.org/x/sync/errgroup"
-	"os"
 
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/fileio"
+	"github.com/hungaikev/rdiff/internal/pkg/librsync"
 	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/pkg/vcdiff"
 	"github.com/hungaikev/rdiff/internal/shared/models"
 	"github.com/hungaikev/rdiff/internal/store"
 )
 
+var tracer = otel.Tracer("apply")
+
 // Apply defines the business logic for application related operations within this library
 type Apply struct {
-	delta   *models.Delta
-	storage store.Storage
-	log     *zerolog.Logger
-	tracer  trace.Tracer
+	delta    *models.Delta
+	storage  store.Storage
+	log      *zerolog.Logger
+	tracer   trace.Tracer
+	inPlace  bool
+	reverse  *models.Delta
+	keyframe int
+}
+
+// Option configures Apply
+type Option func(*Apply)
+
+// WithInPlace makes Changes rewrite the original file in place and truncate it to the length of
+// the updated file, instead of writing a new file next to it. It needs no extra disk space, but
+// a failure part way leaves the file damaged. Deltas that can not be applied in place, see
+// CanApplyInPlace, are still applied through a temporary file.
+func WithInPlace() Option {
+	return func(a *Apply) {
+		a.inPlace = true
+	}
+}
+
+// WithKeyframeInterval makes Changes store the full content of the updated file every k
+// versions, see models.KeyframeAt. It defaults to models.DefaultKeyframeInterval.
+func WithKeyframeInterval(k int) Option {
+	return func(a *Apply) {
+		a.keyframe = k
+	}
 }
 
 // New creates an instance of the Apply implementation
-func New(delta *models.Delta, storage store.Storage, log *zerolog.Logger, tracer trace.Tracer) *Apply {
+func New(delta *models.Delta, storage store.Storage, log *zerolog.Logger, tracer trace.Tracer, options ...Option) *Apply {
 	tracer = otel.Tracer("apply")
-	return &Apply{
-		delta:   delta,
-		storage: storage,
-		log:     log,
-		tracer:  tracer,
+	a := &Apply{
+		delta:    delta,
+		storage:  storage,
+		log:      log,
+		tracer:   tracer,
+		keyframe: models.DefaultKeyframeInterval,
+	}
+	for _, option := range options {
+		option(a)
 	}
+	return a
 }
 
-// Changes applies the changes described in the given Delta to the original file
-func (a *Apply) Changes(ctx context.Context, originalSig *models.Signature) (*models.Signature, error) {
-	ctx, span := a.tracer.Start(ctx, "apply.changes")
+// OpReader reads delta instructions one at a time. It returns io.EOF after the END instruction.
+type OpReader interface {
+	ReadOp() (models.Op, error)
+}
+
+// PatchOption configures Patch
+type PatchOption func(*target)
+
+// WithChecksum makes Patch verify the SHA-256 digest of the updated file. Neither the librsync
+// nor the VCDIFF format carry it, it has to come along with the delta.
+func WithChecksum(checksum []byte) PatchOption {
+	return func(t *target) {
+		t.checksum = checksum
+	}
+}
+
+// Patch reads a delta in the librsync or the VCDIFF format from delta, applies it to the basis
+// and writes the updated file to out. The format is detected from the magic bytes of the delta.
+// The basis is only read, so the output can go to a pipe, a buffer or a new file. librsync
+// deltas are applied as they are read; VCDIFF deltas are decoded first, their copies from the
+// target have to be resolved. It returns the number of bytes written. A *ChecksumError is
+// returned when a checksum is given and the output does not match it, by then the output
+// has been written. VCDIFF windows with an Adler-32 checksum, as xdelta3 writes them, are
+// verified as they are written, a *vcdiff.ChecksumError is returned when one does not match.
+func Patch(ctx context.Context, basis io.ReaderAt, delta io.Reader, out io.Writer, options ...PatchOption) (int64, error) {
+	ctx, span := tracer.Start(ctx, "apply.Patch")
 	defer span.End()
 
-	var g errgroup.Group
-	var original *os.File
+	br := bufio.NewReader(delta)
+
+	bw := bufio.NewWriter(out)
+	w := io.Writer(bw)
 
-	g.Go(func() error {
-		// open the original file
-		original, err := fileio.OpenFile(ctx, originalSig.FilePath)
+	var ops OpReader
+	// a short read is left to the decoder, which reports the truncated header
+	if magic, _ := br.Peek(len(vcdiff.Magic)); vcdiff.IsVCDIFF(magic) {
+		decoded, checksums, err := vcdiff.DecodeChecksums(br)
 		if err != nil {
-			return fmt.Errorf("error opening original file: %w", err)
+			return 0, fmt.Errorf("error reading delta: %w", err)
+		}
+		ops = &opSlice{ops: decoded.Ops}
+		if len(checksums) > 0 {
+			w = vcdiff.NewVerifier(bw, checksums)
 		}
+	} else {
+		ops = librsync.NewDeltaReader(br)
+	}
 
-		defer original.Close()
+	t := target{length: -1}
+	for _, option := range options {
+		option(&t)
+	}
 
-		// apply the changes to the original file
-		for _, chunk := range a.delta.Added {
-			if _, err := original.Write(chunk.Data); err != nil {
-				return fmt.Errorf("error writing added chunk to updated file: %w", err)
-			}
+	written, err := play(ctx, basis, ops, w, t)
+	if flushErr := bw.Flush(); flushErr != nil && err == nil {
+		err = fmt.Errorf("error writing updated file: %w", flushErr)
+	}
+	return written, err
+}
+
+// Rebuild writes the updated file to w by running the delta instructions against the basis
+// (original) file. It stops at the END instruction and returns the number of bytes written.
+// The output is verified against the target length and checksum of the delta, a
+// *ChecksumError is returned when the checksum does not match.
+func Rebuild(ctx context.Context, basis io.ReaderAt, delta *models.Delta, w io.Writer) (int64, error) {
+	ctx, span := tracer.Start(ctx, "apply.Rebuild")
+	defer span.End()
+
+	return play(ctx, basis, &opSlice{ops: delta.Ops}, w, target{length: delta.TargetLength, checksum: delta.Checksum})
+}
+
+// target describes the expected updated file
+type target struct {
+	length   int64  // length in bytes, -1 when unknown
+	checksum []byte // SHA-256 digest, empty when unknown
+}
+
+// play runs the instructions read from ops against the basis file until the END instruction,
+// then verifies the output against the target.
+func play(ctx context.Context, basis io.ReaderAt, ops OpReader, w io.Writer, t target) (int64, error) {
+	checksum := sha256.New()
+	if len(t.checksum) > 0 {
+		w = io.MultiWriter(w, checksum)
+	}
+
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
 		}
-		for _, chunk := range a.delta.Modified {
-			if _, err := original.WriteAt(chunk.Data, chunk.Offset); err != nil {
-				a.log.Error().Msgf("error writing modified chunk to updated file: %v", err)
-				return fmt.Errorf("error writing modified chunk to updated file: %w", err)
+
+		op, err := ops.ReadOp()
+		if err == io.EOF {
+			return written, fmt.Errorf("delta is missing its END instruction")
+		}
+		if err != nil {
+			return written, fmt.Errorf("error reading delta: %w", err)
+		}
+
+		switch op.Kind {
+		case models.OpCopy:
+			n, err := io.Copy(w, io.NewSectionReader(basis, op.Offset, op.Length))
+			written += n
+			if err != nil {
+				return written, fmt.Errorf("error copying %d bytes at offset %d from basis file: %w", op.Length, op.Offset, err)
+			}
+			if n != op.Length {
+				return written, fmt.Errorf("error copying %d bytes at offset %d from basis file: basis file is too short", op.Length, op.Offset)
+			}
+		case models.OpLiteral:
+			n, err := w.Write(op.Data)
+			written += int64(n)
+			if err != nil {
+				return written, fmt.Errorf("error writing literal data: %w", err)
 			}
+		case models.OpEnd:
+			if t.length >= 0 && written != t.length {
+				return written, fmt.Errorf("rebuilt %d bytes, delta expects %d", written, t.length)
+			}
+			if len(t.checksum) > 0 {
+				if actual := checksum.Sum(nil); !bytes.Equal(actual, t.checksum) {
+					return written, &ChecksumError{Expected: t.checksum, Actual: actual}
+				}
+			}
+			return written, nil
+		default:
+			return written, fmt.Errorf("unknown delta instruction: %d", op.Kind)
 		}
+	}
+}
 
-		return nil
+// opSlice is an OpReader over the instructions of a Delta held in memory
+type opSlice struct {
+	ops []models.Op
+}
 
-	})
+// ReadOp implements OpReader
+func (s *opSlice) ReadOp() (models.Op, error) {
+	if len(s.ops) == 0 {
+		return models.Op{}, io.EOF
+	}
+	op := s.ops[0]
+	s.ops = s.ops[1:]
+	return op, nil
+}
 
-	if err := g.Wait(); err != nil {
-		return nil, fmt.Errorf("error applying changes: %w", err)
+// Changes applies the instructions of the Delta to the original file. The updated content is
+// rebuilt from the original file into a temporary file next to it, synced to disk, checked
+// against the length and checksum of the delta, and only then renamed over the original. The
+// signature in storage is updated once the new file is in place, so a failure at any step
+// leaves both the original file and its stored signature untouched. With WithInPlace the
+// original file is rewritten and truncated instead, see RebuildInPlace. Either way the updated
+// file has exactly the target length of the delta, shorter than the original one when the
+// file shrank. The reverse delta, which restores the original file, is computed before the
+// original content is overwritten, see Reverse. The new version is recorded by Record.
+func (a *Apply) Changes(ctx context.Context, originalSig *models.Signature) (*models.Signature, error) {
+	ctx, span := a.tracer.Start(ctx, "apply.changes")
+	defer span.End()
+
+	reverse, err := a.reverseDelta(ctx, originalSig)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case a.inPlace && CanApplyInPlace(a.delta):
+		err = a.writeInPlace(ctx, originalSig.FilePath)
+	case a.inPlace:
+		a.log.Warn().Msgf("delta can not be applied in place, writing a new file: %s", originalSig.FilePath)
+		fallthrough
+	default:
+		err = a.writeAtomic(ctx, originalSig.FilePath)
+	}
+	if err != nil {
+		a.log.Error().Msgf("error writing updated file: %v", err)
+		return nil, err
 	}
 
-	a.log.Info().Msgf("Changes applied successfully - original file updated: %s", original.Name())
+	a.reverse = reverse
+	a.log.Info().Msgf("Changes applied successfully - original file updated: %s", originalSig.FilePath)
 	a.delta.Print()
 
-	// generate the signature of the updated file.
-	newSig, err := signature.Generate(ctx, original, a.log)
+	version, err := a.Record(ctx, originalSig, reverse)
+	if err != nil {
+		return &models.Signature{}, err
+	}
+	return version.Signature, nil
+}
+
+// Record records the file at the path of the original signature, which already holds the
+// updated content, as a new version of it in storage. The version carries the delta of the
+// Apply and the given reverse delta, nil when the original content is gone, as well as the
+// content of the updated file when it is a keyframe, see WithKeyframeInterval.
+func (a *Apply) Record(ctx context.Context, originalSig *models.Signature, reverse *models.Delta) (*models.Version, error) {
+	ctx, span := a.tracer.Start(ctx, "apply.record")
+	defer span.End()
+
+	updatedFile, err := fileio.OpenFile(ctx, originalSig.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening updated file: %w", err)
+	}
+
+	defer updatedFile.Close()
+
+	// generate the signature of the updated file, with the block size and hashes of the original one
+	newSig, err := signature.Generate(ctx, updatedFile, a.log, signature.WithSettingsOf(originalSig))
+	if err != nil {
+		return nil, fmt.Errorf("error generating signature: %w", err)
+	}
+
+	// the updated file replaces the original one in storage
+	newSig.ID = originalSig.ID
+
+	latest, err := a.storage.LatestVersion(ctx, originalSig.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading latest version: %w", err)
+	}
+
+	// record the new version, with the deltas to and from the previous one, in storage
+	version := &models.Version{Signature: newSig, Delta: a.delta, Reverse: reverse}
+	if models.KeyframeAt(latest+1, a.keyframe) {
+		if _, err := updatedFile.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error rewinding updated file: %w", err)
+		}
+		// the storage reads the content as it stores it
+		version.Content = updatedFile
+	}
+	version, err = a.storage.Update(ctx, version)
+	if err != nil {
+		return nil, fmt.Errorf("error saving signature: %w", err)
+	}
+	// the file is closed once recorded
+	version.Content = nil
+
+	a.log.Info().Msgf("Updated signature saved to storage: %s, version %d", version.FilePath, version.Number)
+	version.Signature.Print()
+
+	return version, nil
+}
+
+// Reverse returns the delta that rebuilds the original file from the updated one, once Changes
+// has succeeded. It is nil before.
+func (a *Apply) Reverse() *models.Delta {
+	return a.reverse
+}
+
+// reverseDelta computes the reverse delta from the original file, see diff.Reverse
+func (a *Apply) reverseDelta(ctx context.Context, originalSig *models.Signature) (*models.Delta, error) {
+	original, err := fileio.OpenFile(ctx, originalSig.FilePath)
 	if err != nil {
-		return &models.Signature{}, fmt.Errorf("error generating signature: %w", err)
+		return nil, fmt.Errorf("error opening original file: %w", err)
 	}
+	defer original.Close()
 
-	// update the new signature to storage
-	saved, err := a.storage.Update(ctx, newSig)
+	reverse, err := diff.Reverse(ctx, originalSig, original, a.delta)
 	if err != nil {
-		return &models.Signature{}, fmt.Errorf("error saving signature: %w", err)
+		return nil, fmt.Errorf("error computing reverse delta: %w", err)
 	}
+	return reverse, nil
+}
 
-	a.log.Info().Msgf("Updated signature saved to storage: %s", saved.FilePath)
-	saved.Print()
+// writeAtomic rebuilds the updated file into a temporary file and renames it over the original
+func (a *Apply) writeAtomic(ctx context.Context, path string) error {
+	// open the original file
+	original, err := fileio.OpenFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("error opening original file: %w", err)
+	}
+	defer original.Close()
 
-	return saved, nil
+	info, err := original.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting original file information: %w", err)
+	}
+
+	// rebuild the updated content from the original file and the delta instructions
+	return fileio.WriteAtomic(ctx, path, info.Mode().Perm(), func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+
+		// Rebuild verifies the length and the checksum of the output
+		if _, err := Rebuild(ctx, original, a.delta, bw); err != nil {
+			return fmt.Errorf("error rebuilding updated file: %w", err)
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("error writing updated file: %w", err)
+		}
+		return nil
+	})
+}
+
+// writeInPlace rewrites the original file with the updated content and truncates it
+func (a *Apply) writeInPlace(ctx context.Context, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("error opening original file: %w", err)
+	}
+	defer f.Close()
+
+	if err := RebuildInPlace(ctx, f, a.delta); err != nil {
+		return fmt.Errorf("error rebuilding updated file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing updated file: %w", err)
+	}
+	return f.Close()
 }
@@ -0,0 +1,295 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/librsync"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/pkg/vcdiff"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/memory"
+)
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	basis := bytes.NewReader([]byte("chunk 1 chunk 2 chunk 3 "))
+
+	tests := []struct {
+		name     string
+		ops      []models.Op
+		expected string
+		fails    bool
+	}{
+		{
+			name: "reordered",
+			ops: []models.Op{
+				{Kind: models.OpCopy, Offset: 16, Length: 8},
+				{Kind: models.OpCopy, Offset: 0, Length: 8},
+				{Kind: models.OpEnd},
+			},
+			expected: "chunk 3 chunk 1 ",
+		},
+		{
+			name: "literal and repeated copy",
+			ops: []models.Op{
+				{Kind: models.OpCopy, Offset: 0, Length: 8},
+				{Kind: models.OpLiteral, Length: 4, Data: []byte("new ")},
+				{Kind: models.OpCopy, Offset: 0, Length: 8},
+				{Kind: models.OpEnd},
+			},
+			expected: "chunk 1 new chunk 1 ",
+		},
+		{
+			name:     "truncated to nothing",
+			ops:      []models.Op{{Kind: models.OpEnd}},
+			expected: "",
+		},
+		{
+			name:  "missing end",
+			ops:   []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}},
+			fails: true,
+		},
+		{
+			name: "copy past the end of the basis",
+			ops: []models.Op{
+				{Kind: models.OpCopy, Offset: 20, Length: 8},
+				{Kind: models.OpEnd},
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		delta := &models.Delta{Ops: test.ops, TargetLength: int64(len(test.expected))}
+
+		var out bytes.Buffer
+		n, err := Rebuild(ctx, basis, delta, &out)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if out.String() != test.expected || n != int64(len(test.expected)) {
+			t.Errorf("%s: unexpected output: got %q (%d bytes), want %q", test.name, out.String(), n, test.expected)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ctx := context.Background()
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+	expected := "chunk 3 new chunk 1 chunk 1 "
+
+	delta := &models.Delta{
+		Ops: []models.Op{
+			{Kind: models.OpCopy, Offset: 16, Length: 8},
+			{Kind: models.OpLiteral, Length: 4, Data: []byte("new ")},
+			{Kind: models.OpCopy, Offset: 0, Length: 8},
+			{Kind: models.OpCopy, Offset: 0, Length: 8},
+			{Kind: models.OpEnd},
+		},
+		TargetLength: int64(len(expected)),
+	}
+
+	encoders := map[string]func(io.Writer, *models.Delta) error{
+		"librsync": librsync.EncodeDelta,
+		"vcdiff":   vcdiff.Encode,
+	}
+
+	for name, encode := range encoders {
+		var encoded bytes.Buffer
+		if err := encode(&encoded, delta); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		raw := encoded.Bytes()
+
+		basis := append([]byte(nil), original...)
+		var out bytes.Buffer
+		n, err := Patch(ctx, bytes.NewReader(basis), bytes.NewReader(raw), &out)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if out.String() != expected || n != int64(len(expected)) {
+			t.Errorf("%s: unexpected output: got %q (%d bytes), want %q", name, out.String(), n, expected)
+		}
+		if !bytes.Equal(basis, original) {
+			t.Errorf("%s: the basis was modified", name)
+		}
+
+		// a delta cut short never produces a complete file
+		if _, err := Patch(ctx, bytes.NewReader(basis), bytes.NewReader(raw[:len(raw)-1]), io.Discard); err == nil {
+			t.Errorf("%s: expected an error for a truncated delta", name)
+		}
+	}
+
+	if _, err := Patch(ctx, bytes.NewReader(original), bytes.NewReader([]byte("not a delta")), io.Discard); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestPatchWindowChecksum(t *testing.T) {
+	ctx := context.Background()
+	original := []byte("chunk 1 chunk 2 ")
+
+	// a VCDIFF file laid out like xdelta3 writes them: one window over the first 8 bytes of the
+	// basis, with the Adler-32 checksum of the target window after the section lengths
+	file := func(checksum uint32) []byte {
+		b := append(vcdiff.Magic[:], 0)
+		b = append(b, 0x05, 8, 0, 12)
+		b = append(b, 8, 0, 0, 2, 1)
+		b = binary.BigEndian.AppendUint32(b, checksum)
+		return append(b, 19, 8, 0)
+	}
+	checksum := adler32.Checksum(original[:8])
+
+	var out bytes.Buffer
+	if _, err := Patch(ctx, bytes.NewReader(original), bytes.NewReader(file(checksum)), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "chunk 1 " {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	_, err := Patch(ctx, bytes.NewReader(original), bytes.NewReader(file(checksum+1)), io.Discard)
+	var checksumErr *vcdiff.ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Errorf("unexpected error: got %v, want a *vcdiff.ChecksumError", err)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	tracer := otel.Tracer("tests")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+	updated := []byte("chunk 3 chunk 1 ")
+	if err := os.WriteFile(path, original, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	storage := memory.New(&log, tracer)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sig, err := signature.Generate(ctx, file, &log, signature.WithBlockSize(8))
+	file.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := storage.Save(ctx, &models.Version{Signature: sig}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delta, err := diff.Compare(ctx, sig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a corrupt delta leaves the file, the directory and the storage untouched
+	corrupt := *delta
+	corrupt.Checksum = make([]byte, len(delta.Checksum))
+	_, err = New(&corrupt, storage, &log, tracer).Changes(ctx, sig)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("unexpected error: got %v, want a *ChecksumError", err)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, original) {
+		t.Errorf("original file was modified: %q", b)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("unexpected files left in the directory: %d entries", len(entries))
+	}
+	if stored, _ := storage.Get(ctx, sig.ID); stored != sig {
+		t.Errorf("stored signature was updated")
+	}
+
+	a := New(delta, storage, &log, tracer, WithKeyframeInterval(1))
+	saved, err := a.Changes(ctx, sig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, updated) {
+		t.Errorf("unexpected updated file: %q", b)
+	}
+
+	// the reverse delta restores the original file
+	var restored bytes.Buffer
+	if _, err := Rebuild(ctx, bytes.NewReader(updated), a.Reverse(), &restored); err != nil {
+		t.Errorf("unexpected error applying the reverse delta: %v", err)
+	} else if !bytes.Equal(restored.Bytes(), original) {
+		t.Errorf("unexpected restored file: %q", restored.Bytes())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions of the updated file: %v, %v", info.Mode(), err)
+	}
+	if stored, _ := storage.Get(ctx, sig.ID); stored != saved || stored.FileSize != int64(len(updated)) {
+		t.Errorf("stored signature was not updated")
+	}
+	if versions, _ := storage.ListVersions(ctx, path); len(versions) != 2 || versions[1].Delta != delta || versions[1].Reverse != a.Reverse() {
+		t.Errorf("new version was not recorded with its deltas")
+	}
+	if v, err := storage.GetVersion(ctx, path, 2); err != nil || !bytes.Equal(v.Snapshot, updated) {
+		t.Errorf("new version was not recorded with its snapshot: %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	basis := bytes.NewReader([]byte("chunk 1 chunk 2 "))
+	expected := sha256.Sum256([]byte("chunk 2 "))
+
+	delta := &models.Delta{
+		Ops:          []models.Op{{Kind: models.OpCopy, Offset: 8, Length: 8}, {Kind: models.OpEnd}},
+		TargetLength: 8,
+		Checksum:     expected[:],
+	}
+	if _, err := Rebuild(ctx, basis, delta, io.Discard); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// same length, different content
+	delta.Ops[0].Offset = 0
+	_, err := Rebuild(ctx, basis, delta, io.Discard)
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) {
+		t.Fatalf("unexpected error: got %v, want a *ChecksumError", err)
+	}
+	if !bytes.Equal(checksumErr.Expected, expected[:]) {
+		t.Errorf("unexpected expected checksum: got %x, want %x", checksumErr.Expected, expected)
+	}
+
+	// librsync deltas do not carry the checksum, it is passed along
+	var encoded bytes.Buffer
+	if err := librsync.EncodeDelta(&encoded, delta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := Patch(ctx, basis, bytes.NewReader(encoded.Bytes()), io.Discard); err != nil {
+		t.Errorf("unexpected error without a checksum: %v", err)
+	}
+	if _, err := Patch(ctx, basis, bytes.NewReader(encoded.Bytes()), io.Discard, WithChecksum(expected[:])); !errors.As(err, &checksumErr) {
+		t.Errorf("unexpected error: got %v, want a *ChecksumError", err)
+	}
+}
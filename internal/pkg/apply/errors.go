@@ -0,0 +1,18 @@
+package apply
+
+import (
+	"fmt"
+)
+
+// ChecksumError is returned when the rebuilt file does not match the checksum of the file the
+// delta was computed from: the basis is not the file the signature was made of, or the delta
+// or the basis is corrupt.
+type ChecksumError struct {
+	Expected []byte // SHA-256 digest of the updated file, as recorded in the delta
+	Actual   []byte // SHA-256 digest of the rebuilt file
+}
+
+// Error implements error
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: rebuilt file has checksum %x, delta expects %x", e.Actual, e.Expected)
+}
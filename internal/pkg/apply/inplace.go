@@ -0,0 +1,114 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// copyBufferSize is the size of the buffer used to move bytes within a file
+const copyBufferSize = 32 * 1024
+
+// File is a file that is both the basis and the output of an in-place rebuild
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// CanApplyInPlace reports whether the delta can be applied over its own basis. Every COPY must
+// read from at or after the position it writes to, so that it never reads bytes an earlier
+// instruction has already overwritten.
+func CanApplyInPlace(delta *models.Delta) bool {
+	var pos int64
+	for _, op := range delta.Ops {
+		if op.Kind == models.OpCopy && op.Offset < pos {
+			return false
+		}
+		pos += op.Length
+	}
+	return true
+}
+
+// RebuildInPlace applies the delta to f, which holds the basis, and truncates f to the target
+// length of the delta, so the file shrinks when the updated file is shorter than the original.
+// Copies that are already in place are skipped. The delta must pass CanApplyInPlace. When the
+// delta has a checksum the rebuilt file is read back and verified, a *ChecksumError means the
+// file has been modified but does not hold the expected content.
+func RebuildInPlace(ctx context.Context, f File, delta *models.Delta) error {
+	ctx, span := tracer.Start(ctx, "apply.RebuildInPlace")
+	defer span.End()
+
+	if !CanApplyInPlace(delta) {
+		return fmt.Errorf("delta can not be applied in place: a copy reads bytes that were already overwritten")
+	}
+
+	buf := make([]byte, copyBufferSize)
+	var pos int64
+
+	for _, op := range delta.Ops {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch op.Kind {
+		case models.OpCopy:
+			// moving bytes towards the start of the file, front to back, never overwrites
+			// bytes that are still to be read
+			for done := int64(0); done < op.Length && op.Offset != pos; {
+				n := int64(len(buf))
+				if rest := op.Length - done; rest < n {
+					n = rest
+				}
+				read, err := f.ReadAt(buf[:n], op.Offset+done)
+				if int64(read) != n {
+					if err == nil || err == io.EOF {
+						err = fmt.Errorf("basis file is too short")
+					}
+					return fmt.Errorf("error copying %d bytes at offset %d from basis file: %w", op.Length, op.Offset, err)
+				}
+				if _, err := f.WriteAt(buf[:n], pos+done); err != nil {
+					return fmt.Errorf("error writing updated file: %w", err)
+				}
+				done += n
+			}
+			pos += op.Length
+		case models.OpLiteral:
+			if _, err := f.WriteAt(op.Data, pos); err != nil {
+				return fmt.Errorf("error writing literal data: %w", err)
+			}
+			pos += op.Length
+		case models.OpEnd:
+			if pos != delta.TargetLength {
+				return fmt.Errorf("rebuilt %d bytes, delta expects %d", pos, delta.TargetLength)
+			}
+			if err := f.Truncate(pos); err != nil {
+				return fmt.Errorf("error truncating updated file: %w", err)
+			}
+			return verify(f, delta)
+		default:
+			return fmt.Errorf("unknown delta instruction: %d", op.Kind)
+		}
+	}
+	return fmt.Errorf("delta is missing its END instruction")
+}
+
+// verify reads the rebuilt file back and compares it to the checksum of the delta
+func verify(f io.ReaderAt, delta *models.Delta) error {
+	if len(delta.Checksum) == 0 {
+		return nil
+	}
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, io.NewSectionReader(f, 0, delta.TargetLength)); err != nil {
+		return fmt.Errorf("error reading updated file: %w", err)
+	}
+	if actual := checksum.Sum(nil); !bytes.Equal(actual, delta.Checksum) {
+		return &ChecksumError{Expected: delta.Checksum, Actual: actual}
+	}
+	return nil
+}
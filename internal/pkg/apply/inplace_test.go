@@ -0,0 +1,161 @@
+package apply
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/memory"
+)
+
+func TestCanApplyInPlace(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []models.Op
+		want bool
+	}{
+		{"empty", []models.Op{{Kind: models.OpEnd}}, true},
+		{"same position", []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}, {Kind: models.OpEnd}}, true},
+		{"moves back", []models.Op{{Kind: models.OpLiteral, Length: 2, Data: []byte("ab")}, {Kind: models.OpCopy, Offset: 8, Length: 8}, {Kind: models.OpEnd}}, true},
+		{"reads overwritten bytes", []models.Op{{Kind: models.OpLiteral, Length: 2, Data: []byte("ab")}, {Kind: models.OpCopy, Offset: 0, Length: 8}, {Kind: models.OpEnd}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanApplyInPlace(&models.Delta{Ops: tt.ops}); got != tt.want {
+				t.Errorf("unexpected result: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRebuildInPlace(t *testing.T) {
+	ctx := context.Background()
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+
+	tests := []struct {
+		name string
+		ops  []models.Op
+		want string
+	}{
+		{"shrink", []models.Op{{Kind: models.OpCopy, Offset: 16, Length: 8}, {Kind: models.OpEnd}}, "chunk 3 "},
+		{"truncate to empty", []models.Op{{Kind: models.OpEnd}}, ""},
+		{"keep prefix", []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}, {Kind: models.OpEnd}}, "chunk 1 "},
+		{"grow", []models.Op{
+			{Kind: models.OpCopy, Offset: 0, Length: 24},
+			{Kind: models.OpLiteral, Length: 8, Data: []byte("chunk 4 ")},
+			{Kind: models.OpEnd},
+		}, "chunk 1 chunk 2 chunk 3 chunk 4 "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.txt")
+			if err := os.WriteFile(path, original, 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer f.Close()
+
+			checksum := sha256.Sum256([]byte(tt.want))
+			delta := &models.Delta{Ops: tt.ops, TargetLength: int64(len(tt.want)), Checksum: checksum[:]}
+			if err := RebuildInPlace(ctx, f, delta); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if b, _ := os.ReadFile(path); string(b) != tt.want {
+				t.Errorf("unexpected updated file: got %q, want %q", b, tt.want)
+			}
+		})
+	}
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "file.txt")
+		if err := os.WriteFile(path, original, 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer f.Close()
+
+		delta := &models.Delta{
+			Ops:          []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}, {Kind: models.OpEnd}},
+			TargetLength: 8,
+			Checksum:     make([]byte, sha256.Size),
+		}
+		var checksumErr *ChecksumError
+		if err := RebuildInPlace(ctx, f, delta); !errors.As(err, &checksumErr) {
+			t.Errorf("unexpected error: got %v, want a *ChecksumError", err)
+		}
+	})
+}
+
+func TestChangesInPlace(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	tracer := otel.Tracer("tests")
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+
+	tests := []struct {
+		name    string
+		updated []byte
+	}{
+		// every copy moves towards the start of the file
+		{"in place", []byte("chunk 2 chunk 3 ")},
+		// chunk 1 is overwritten before it is copied, the delta goes through a temporary file
+		{"fallback", []byte("chunk 3 chunk 1 ")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file.txt")
+			if err := os.WriteFile(path, original, 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			storage := memory.New(&log, tracer)
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sig, err := signature.Generate(ctx, file, &log, signature.WithBlockSize(8))
+			file.Close()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := storage.Save(ctx, &models.Version{Signature: sig}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			delta, err := diff.Compare(ctx, sig, bytes.NewReader(tt.updated))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			saved, err := New(delta, storage, &log, tracer, WithInPlace()).Changes(ctx, sig)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if b, _ := os.ReadFile(path); !bytes.Equal(b, tt.updated) {
+				t.Errorf("unexpected updated file: got %q, want %q", b, tt.updated)
+			}
+			if saved.FileSize != int64(len(tt.updated)) {
+				t.Errorf("unexpected size in the signature: got %d, want %d", saved.FileSize, len(tt.updated))
+			}
+		})
+	}
+}
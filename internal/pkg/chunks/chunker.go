@@ -0,0 +1,56 @@
+package chunks
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Chunker splits a stream of data into chunks
+type Chunker interface {
+	// Next returns the data of the next chunk, or io.EOF once the stream is exhausted.
+	// The returned slice is only valid until the next call.
+	Next() ([]byte, error)
+}
+
+// NewChunker returns the Chunker selected by the options, reading from r
+func NewChunker(r io.Reader, opts Options) (Chunker, error) {
+	switch opts.Chunking {
+	case models.ChunkingFixed:
+		if opts.BlockSize == 0 {
+			return NewFixed(r, DefaultSize), nil
+		}
+		if err := ValidateBlockSize(opts.BlockSize); err != nil {
+			return nil, err
+		}
+		return NewFixed(r, opts.BlockSize), nil
+	case models.ChunkingFastCDC:
+		return NewFastCDC(r, opts.ChunkSizes)
+	default:
+		return nil, fmt.Errorf("unknown chunking: %d", opts.Chunking)
+	}
+}
+
+// fixed cuts chunks of a fixed size, only the last chunk may be shorter
+type fixed struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewFixed returns a Chunker cutting chunks of the given size
+func NewFixed(r io.Reader, size int) Chunker {
+	return &fixed{r: r, buf: make([]byte, size)}
+}
+
+// Next implements Chunker
+func (f *fixed) Next() ([]byte, error) {
+	n, err := io.ReadFull(f.r, f.buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	return f.buf[:n], nil
+}
@@ -2,59 +2,103 @@ package chunks
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"math"
+
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel"
-	"io"
-	"os"
 
 	"github.com/hungaikev/rdiff/internal/pkg/rolling"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
 	"github.com/hungaikev/rdiff/internal/shared/models"
 )
 
 var tracer = otel.Tracer("chunks")
 
-const chunkSize = 8192 // size of each chunk in bytes
+// DefaultSize is the default size of the fixed blocks in bytes
+const DefaultSize = 8192
+
+// Bounds of the block sizes picked by AutoBlockSize
+const (
+	MinAutoBlockSize = 700
+	MaxAutoBlockSize = 1 << 17
+)
+
+// MaxBlockSize is the largest block size accepted for fixed chunking. The delta of a file
+// buffers about twice the block size.
+const MaxBlockSize = 1 << 24
+
+// AutoBlockSize picks the block size of a file from its length, like rsync does: the square
+// root of the length, rounded down to a multiple of 8 and clamped to [MinAutoBlockSize,
+// MaxAutoBlockSize]. It balances the size of the signature, which grows with the number of
+// blocks, against the size of the delta, which grows with the size of the blocks.
+func AutoBlockSize(fileSize int64) int {
+	size := int(math.Sqrt(float64(fileSize))) &^ 7
+	if size < MinAutoBlockSize {
+		return MinAutoBlockSize
+	}
+	if size > MaxAutoBlockSize {
+		return MaxAutoBlockSize
+	}
+	return size
+}
+
+// ValidateBlockSize checks that the block size of fixed chunking is usable
+func ValidateBlockSize(size int) error {
+	if size <= 0 || size > MaxBlockSize {
+		return fmt.Errorf("invalid block size %d: expected between 1 and %d", size, MaxBlockSize)
+	}
+	return nil
+}
+
+// Options configures how a file is split into chunks and how the chunks are digested
+type Options struct {
+	WeakHash   models.WeakHash   // rolling checksum of the weak hash
+	StrongHash models.StrongHash // algorithm of the strong digest
+	StrongLen  int               // length in bytes the strong digest is truncated to
+	BlockSize  int               // size of the blocks of fixed chunking, DefaultSize when 0
+	Chunking   models.Chunking   // algorithm that splits the file into chunks
+	ChunkSizes models.ChunkSizes // chunk sizes of content-defined chunking
+}
 
-// Generate reads the given file chunk by chunk and returns a slice of Chunk structs
-func Generate(ctx context.Context, file *os.File, log *zerolog.Logger) ([]models.Chunk, error) {
+// Generate reads the given stream chunk by chunk and returns a slice of Chunk structs.
+// The chunk boundaries are chosen by the Chunker of the options. Only the digests of
+// every chunk are kept, the data itself is discarded, so memory use does not depend on
+// the length of the stream beyond the chunks themselves.
+func Generate(ctx context.Context, r io.Reader, log *zerolog.Logger, opts Options) ([]models.Chunk, error) {
 	ctx, span := tracer.Start(ctx, "chunks.Generate")
 	defer span.End()
 
-	// create a buffer to read the file chunk by chunk
-	buf := make([]byte, chunkSize)
+	// create the chunker that splits the stream
+	chunker, err := NewChunker(r, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	// create a slice to store the chunks
 	chunks := make([]models.Chunk, 0)
 
-	// initialize the rolling hash value to 0
-	rollingHash := uint64(0)
-
 	// initialize the offset to 0
 	offset := int64(0)
 
-	// read the file chunk by chunk
+	// read the stream chunk by chunk
 	for {
-		// read a chunk of data
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			// if there was an error other than EOF, return it
-			return nil, err
-		}
-		if n == 0 {
-			// if no data was read, we've reached the end of the file
+		// read the next chunk of data
+		data, err := chunker.Next()
+		if err == io.EOF {
+			// we've reached the end of the stream
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
+		n := len(data)
 
-		// calculate the rolling hash value for the chunk
-		rollingHash = rolling.Hash(ctx, buf[:n])
-
-		// update the offset
-		offset += int64(n)
-
-		// create a new chunk with the data and rolling hash value
+		// create a new chunk with the weak and strong hashes of the data
 		chunk := models.Chunk{
-			Data:   buf[:n],
-			Hash:   rollingHash,
+			Weak:   rolling.Sum(opts.WeakHash, data),
+			Strong: strong.Sum(opts.StrongHash, opts.StrongLen, data),
 			Offset: offset,
 			Length: int64(n),
 		}
@@ -62,9 +106,11 @@ func Generate(ctx context.Context, file *os.File, log *zerolog.Logger) ([]models
 		// add the chunk to the slice
 		chunks = append(chunks, chunk)
 
+		// update the offset
+		offset += int64(n)
 	}
 
-	log.Info().Msgf("generated %d chunks for file %s", len(chunks), file.Name())
+	log.Info().Msgf("generated %d chunks from %d bytes", len(chunks), offset)
 
 	return chunks, nil
 }
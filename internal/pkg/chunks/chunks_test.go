@@ -0,0 +1,22 @@
+package chunks
+
+import "testing"
+
+func TestAutoBlockSize(t *testing.T) {
+	tests := []struct {
+		fileSize int64
+		expected int
+	}{
+		{0, MinAutoBlockSize},
+		{10, MinAutoBlockSize},
+		{1000000, 1000},
+		{1 << 30, 32768},
+		{50 << 30, MaxAutoBlockSize},
+	}
+
+	for _, test := range tests {
+		if got := AutoBlockSize(test.fileSize); got != test.expected {
+			t.Errorf("unexpected block size for %d bytes: got %d, want %d", test.fileSize, got, test.expected)
+		}
+	}
+}
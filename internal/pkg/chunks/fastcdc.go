@@ -0,0 +1,145 @@
+package chunks
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Bounds of the FastCDC chunk sizes. The chunker buffers twice the maximum chunk size.
+const (
+	MinFastCDCSize = 64
+	MaxFastCDCSize = 1 << 24
+)
+
+// DefaultChunkSizes are the FastCDC chunk sizes used when none are given
+var DefaultChunkSizes = models.ChunkSizes{Min: 2048, Avg: DefaultSize, Max: 65536}
+
+// gear maps every byte to a random 64-bit value. The table must never change: chunk
+// boundaries, and so every stored signature, depend on it.
+var gear = buildGear()
+
+// buildGear fills the gear table with the splitmix64 sequence of a fixed seed
+func buildGear() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5244494646434443) // "RDIFFCDC"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}
+
+// fastCDC cuts chunks at content-defined boundaries with the FastCDC algorithm: a gear hash
+// is rolled over the data and a chunk ends where the top bits of the hash are all zero.
+// Normalized chunking uses a harder mask before the average size and an easier one after
+// it, which keeps the chunk sizes close to the average.
+type fastCDC struct {
+	r     io.Reader
+	sizes models.ChunkSizes
+	maskS uint64 // mask used before the average size
+	maskL uint64 // mask used after the average size
+
+	buf        []byte
+	start, end int // unread data of buf
+	eof        bool
+}
+
+// ValidateChunkSizes checks that the FastCDC chunk sizes are usable
+func ValidateChunkSizes(sizes models.ChunkSizes) error {
+	if sizes.Min < MinFastCDCSize || sizes.Max > MaxFastCDCSize || sizes.Min > sizes.Avg || sizes.Avg > sizes.Max {
+		return fmt.Errorf("invalid chunk sizes %d/%d/%d: expected %d <= min <= avg <= max <= %d",
+			sizes.Min, sizes.Avg, sizes.Max, MinFastCDCSize, MaxFastCDCSize)
+	}
+	return nil
+}
+
+// NewFastCDC returns a Chunker cutting content-defined chunks of the given sizes
+func NewFastCDC(r io.Reader, sizes models.ChunkSizes) (Chunker, error) {
+	if err := ValidateChunkSizes(sizes); err != nil {
+		return nil, err
+	}
+
+	// a mask of n bits matches once every 2^n bytes on average
+	n := bits.Len(uint(sizes.Avg)) - 1
+	return &fastCDC{
+		r:     r,
+		sizes: sizes,
+		maskS: topBits(n + 2),
+		maskL: topBits(n - 2),
+		buf:   make([]byte, 2*sizes.Max),
+	}, nil
+}
+
+// topBits returns a mask of the n most significant bits. The top bits of the gear hash
+// depend on the last 64 bytes, the lower bits on fewer bytes.
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next implements Chunker
+func (c *fastCDC) Next() ([]byte, error) {
+	if c.end-c.start < c.sizes.Max && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill moves the unread data to the start of the buffer and reads until the buffer is full
+func (c *fastCDC) fill() error {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.sizes.Min {
+		return n
+	}
+	if n > c.sizes.Max {
+		n = c.sizes.Max
+	}
+	normal := c.sizes.Avg
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.sizes.Min
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package chunks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// split returns the chunks of data cut by a FastCDC chunker
+func split(t *testing.T, r io.Reader, sizes models.ChunkSizes) [][]byte {
+	t.Helper()
+
+	c, err := NewFastCDC(r, sizes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestFastCDCSizes(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	sizes := models.ChunkSizes{Min: 1024, Avg: 4096, Max: 16384}
+
+	chunks := split(t, bytes.NewReader(data), sizes)
+	if joined := bytes.Join(chunks, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("chunks do not add up to the data")
+	}
+
+	for i, chunk := range chunks {
+		if len(chunk) > sizes.Max || (len(chunk) < sizes.Min && i != len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes, expected between %d and %d", i, len(chunk), sizes.Min, sizes.Max)
+		}
+	}
+
+	// normalized chunking keeps the average close to the requested one
+	avg := len(data) / len(chunks)
+	if avg < sizes.Avg/2 || avg > sizes.Avg*2 {
+		t.Errorf("unexpected average chunk size: got %d, want about %d", avg, sizes.Avg)
+	}
+
+	// the boundaries do not depend on how the data is read
+	if got := split(t, iotest.OneByteReader(bytes.NewReader(data)), sizes); len(got) != len(chunks) {
+		t.Errorf("unexpected chunks with one byte reads: got %d, want %d", len(got), len(chunks))
+	}
+}
+
+func TestFastCDCInsertion(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted bytes"...), data[500000:]...)
+
+	sizes := DefaultChunkSizes
+	original := make(map[[32]byte]bool)
+	for _, chunk := range split(t, bytes.NewReader(data), sizes) {
+		original[sha256.Sum256(chunk)] = true
+	}
+
+	// only the chunks around the insertion change
+	changed := 0
+	for _, chunk := range split(t, bytes.NewReader(edited), sizes) {
+		if !original[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("unexpected changed chunks: got %d, want 1 or 2", changed)
+	}
+}
+
+func TestFastCDCInvalidSizes(t *testing.T) {
+	tests := []models.ChunkSizes{
+		{Min: 0, Avg: 4096, Max: 16384},
+		{Min: 8192, Avg: 4096, Max: 16384},
+		{Min: 1024, Avg: 32768, Max: 16384},
+		{Min: 1024, Avg: 4096, Max: MaxFastCDCSize + 1},
+	}
+	for _, sizes := range tests {
+		if _, err := NewFastCDC(bytes.NewReader(nil), sizes); err == nil {
+			t.Errorf("expected an error for chunk sizes %+v", sizes)
+		}
+	}
+}
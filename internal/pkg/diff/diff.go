@@ -4,50 +4,407 @@ package diff
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
 
 	"go.opentelemetry.io/otel"
 
+	"github.com/hungaikev/rdiff/internal/pkg/chunks"
+	"github.com/hungaikev/rdiff/internal/pkg/rolling"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
 	"github.com/hungaikev/rdiff/internal/shared/models"
 )
 
 var tracer = otel.Tracer("diff")
 
-/*
-Compare compares the original and updated signatures and returns a Delta struct containing the differences between the two.
+// maxLiteral is the largest literal instruction emitted while streaming. Longer runs of
+// unmatched bytes are split, so the bytes waiting for a match never exceed it.
+const maxLiteral = 1 << 16
+
+// readSize is the size of the reads from the updated file
+const readSize = 1 << 16
+
+// OpWriter receives the delta instructions as they are produced. The Data of a LITERAL
+// instruction is only valid during the call to WriteOp.
+type OpWriter interface {
+	WriteOp(op models.Op) error
+}
 
-1. Creates a new Delta struct and initializes its fields with empty slices and a map.
-2. Compares the number of chunks in the original and updated signatures. If they are not the same, it assumes that the entire file has been modified and sets the Modified field of the Delta struct to the Chunks field of the updated signature.
-3. If the number of chunks is the same, it compares the rolling hash values of each chunk using a for loop. If the hash values are different, it assumes that the chunk has been modified and adds it to the Modified field of the Delta struct.
-4. Returns the Delta pointer and a nil error value if successful, or returns a nil pointer and an error value if there was an error.
+// Summary describes a streamed delta
+type Summary struct {
+	Ops          int    // number of instructions written, including END
+	LiteralBytes int64  // number of literal bytes written
+	TargetLength int64  // length of the updated file in bytes
+	Checksum     []byte // SHA-256 digest of the updated file
+}
+
+/*
+Compare compares the original signature with the updated file and returns a Delta containing the
+instructions that rebuild the updated file from the original one. The whole delta is held in
+memory, use Stream to write the instructions as they are produced.
 */
-func Compare(ctx context.Context, original, updated *models.Signature) (*models.Delta, error) {
+func Compare(ctx context.Context, original *models.Signature, updated io.Reader) (*models.Delta, error) {
 	ctx, span := tracer.Start(ctx, "diff.Compare")
 	defer span.End()
 
 	// create a new delta
-	delta := &models.Delta{
-		Added:    make([]models.Chunk, 0),
-		Modified: make([]models.Chunk, 0),
-		Metadata: make(map[string]string),
+	delta := &models.Delta{Ops: make([]models.Op, 0)}
+
+	summary, err := Stream(ctx, original, updated, (*collector)(delta))
+	if err != nil {
+		return nil, err
 	}
 
-	// check if the original and updated signatures have the same number of chunks
-	if len(original.Chunks) != len(updated.Chunks) {
-		// if not, the entire file has been modified
-		delta.Modified = updated.Chunks
-		return delta, nil
+	delta.TargetLength = summary.TargetLength
+	delta.Checksum = summary.Checksum
+	return delta, nil
+}
+
+// collector is an OpWriter building a Delta in memory
+type collector models.Delta
+
+// WriteOp implements OpWriter
+func (c *collector) WriteOp(op models.Op) error {
+	delta := (*models.Delta)(c)
+	switch op.Kind {
+	case models.OpCopy:
+		delta.AddCopy(op.Offset, op.Length)
+	case models.OpLiteral:
+		delta.AddLiteral(op.Data)
+	case models.OpEnd:
+		delta.End()
 	}
+	return nil
+}
+
+/*
+Stream compares the original signature with the updated file and writes the instructions that
+rebuild the updated file from the original one to w, as the updated file is read. This is the
+rsync algorithm:
+
+1. Indexes the chunks of the original signature by their weak rolling checksum.
+2. Slides a window of one block over the updated file, one byte at a time, updating the rolling checksum in constant time.
+3. When the weak checksum of the window is found in the index, confirms the candidate by comparing the strong digest of the window.
+4. On a match, emits a COPY instruction for the original block and jumps over the window. Bytes skipped before the match are emitted as a LITERAL instruction.
+5. Terminates the instructions with END and returns the length and SHA-256 checksum of the updated file.
 
-	// compare the rolling hash values of each chunk
-	for i := range original.Chunks {
+Because matches are searched at every byte offset, inserting or removing bytes only costs the changed bytes plus at most a block around them.
+Memory use is bounded by the signature plus one window of the updated file: literal bytes are written out at most maxLiteral at a time.
 
-		result := bytes.Compare(original.Chunks[i].Data, updated.Chunks[i].Data)
+Signatures of content-defined chunks are matched chunk by chunk instead, see streamChunks.
+*/
+func Stream(ctx context.Context, original *models.Signature, updated io.Reader, w OpWriter) (*Summary, error) {
+	ctx, span := tracer.Start(ctx, "diff.Stream")
+	defer span.End()
 
-		if result != 0 {
-			// if the hash values are different, the chunk has been modified
-			delta.Modified = append(delta.Modified, updated.Chunks[i])
+	e := &emitter{w: w}
+	checksum := sha256.New()
+	r := io.TeeReader(updated, checksum)
+
+	index := newIndex(original)
+	if index.blockSize > 0 {
+		if err := strong.Validate(index.strongHash, index.strongLen); err != nil {
+			return nil, fmt.Errorf("invalid signature: %w", err)
 		}
 	}
 
-	return delta, nil
+	var err error
+	switch {
+	case index.blockSize == 0:
+		// nothing to match against, the whole file is new
+		err = streamLiterals(e, r)
+	case original.Chunking == models.ChunkingFastCDC:
+		err = streamChunks(e, original, index, r)
+	default:
+		err = streamBlocks(e, index, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.end(); err != nil {
+		return nil, err
+	}
+
+	e.summary.Checksum = checksum.Sum(nil)
+	return &e.summary, nil
+}
+
+// streamLiterals writes the whole updated file as literals
+func streamLiterals(e *emitter, r io.Reader) error {
+	buf := make([]byte, readSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err := e.literal(buf[:n]); err != nil {
+			return err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading updated file: %w", err)
+		}
+	}
+}
+
+// streamBlocks runs the rolling checksum over the updated file
+func streamBlocks(e *emitter, index *index, r io.Reader) error {
+	blockSize := index.blockSize
+	win := &buffer{r: r, buf: make([]byte, 0, 2*(blockSize+maxLiteral)+readSize)}
+
+	// the window holds [i, i+blockSize), bytes from lit to i are waiting to be written as a literal
+	i, lit := 0, 0
+
+	if err := win.fill(i+blockSize, &lit, &i); err != nil {
+		return err
+	}
+	sum := rolling.New(index.weakHash)
+	sum.Update(win.buf[:minInt(blockSize, len(win.buf))])
+
+	for i < len(win.buf) {
+		end := minInt(i+blockSize, len(win.buf))
+
+		if chunk := index.lookup(sum.Sum(), win.buf[i:end]); chunk != nil {
+			if err := e.literal(win.buf[lit:i]); err != nil {
+				return err
+			}
+			if err := e.copy(chunk.Offset, int64(end-i)); err != nil {
+				return err
+			}
+
+			i = end
+			lit = i
+
+			if err := win.fill(i+blockSize, &lit, &i); err != nil {
+				return err
+			}
+			sum.Reset()
+			sum.Update(win.buf[i:minInt(i+blockSize, len(win.buf))])
+			continue
+		}
+
+		// slide the window one byte, shrinking it once it reaches the end of the file
+		if err := win.fill(i+blockSize+1, &lit, &i); err != nil {
+			return err
+		}
+		if end = i + blockSize; end < len(win.buf) {
+			sum.Roll(win.buf[i], win.buf[end])
+		} else {
+			sum.RollOut(win.buf[i])
+		}
+		i++
+
+		// bytes before the window can not be part of a match anymore
+		if i-lit >= maxLiteral {
+			if err := e.literal(win.buf[lit:i]); err != nil {
+				return err
+			}
+			lit = i
+		}
+	}
+
+	return e.literal(win.buf[lit:i])
+}
+
+// streamChunks splits the updated file with the chunker of the original signature and copies
+// every chunk found in the signature. Content-defined boundaries follow the data, so the
+// chunks of unchanged regions are cut identically in both files and no byte-by-byte search
+// is needed.
+func streamChunks(e *emitter, original *models.Signature, index *index, r io.Reader) error {
+	chunker, err := chunks.NewChunker(r, chunks.Options{Chunking: original.Chunking, ChunkSizes: original.ChunkSizes})
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading updated file: %w", err)
+		}
+
+		if c := index.lookupExact(rolling.Sum(index.weakHash, chunk), chunk); c != nil {
+			err = e.copy(c.Offset, c.Length)
+		} else {
+			err = e.literal(chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// buffer holds the part of the updated file being scanned
+type buffer struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+// fill reads until the buffer holds n bytes or the file ends. When the buffer is full, the
+// bytes before lit are dropped and the positions lit and i are moved accordingly.
+func (w *buffer) fill(n int, lit, i *int) error {
+	for len(w.buf) < n && !w.eof {
+		if len(w.buf) == cap(w.buf) {
+			w.buf = w.buf[:copy(w.buf, w.buf[*lit:])]
+			n -= *lit
+			*i -= *lit
+			*lit = 0
+		}
+
+		read, err := w.r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+read]
+		if err == io.EOF {
+			w.eof = true
+		} else if err != nil {
+			return fmt.Errorf("error reading updated file: %w", err)
+		}
+	}
+	return nil
+}
+
+// emitter writes instructions to an OpWriter, merging contiguous copies
+type emitter struct {
+	w       OpWriter
+	pending models.Op // COPY instruction not written yet
+	summary Summary
+}
+
+// copy emits a COPY instruction
+func (e *emitter) copy(offset, length int64) error {
+	e.summary.TargetLength += length
+	if e.pending.Length > 0 && e.pending.Offset+e.pending.Length == offset {
+		e.pending.Length += length
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	e.pending = models.Op{Kind: models.OpCopy, Offset: offset, Length: length}
+	return nil
+}
+
+// literal emits a LITERAL instruction
+func (e *emitter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	e.summary.TargetLength += int64(len(data))
+	e.summary.LiteralBytes += int64(len(data))
+	return e.write(models.Op{Kind: models.OpLiteral, Length: int64(len(data)), Data: data})
+}
+
+// end emits the END instruction
+func (e *emitter) end() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.write(models.Op{Kind: models.OpEnd})
+}
+
+// flush writes the pending COPY instruction
+func (e *emitter) flush() error {
+	if e.pending.Length == 0 {
+		return nil
+	}
+	op := e.pending
+	e.pending = models.Op{}
+	return e.write(op)
+}
+
+// write writes an instruction to the OpWriter
+func (e *emitter) write(op models.Op) error {
+	e.summary.Ops++
+	if err := e.w.WriteOp(op); err != nil {
+		return fmt.Errorf("error writing delta instruction: %w", err)
+	}
+	return nil
+}
+
+// index maps weak checksums to the chunks of a signature
+type index struct {
+	blockSize  int
+	weakHash   models.WeakHash
+	strongHash models.StrongHash
+	strongLen  int
+	chunks     map[uint32][]*models.Chunk
+}
+
+// newIndex indexes the chunks of the given signature by weak checksum
+func newIndex(sig *models.Signature) *index {
+	idx := &index{chunks: make(map[uint32][]*models.Chunk)}
+	if sig == nil || len(sig.Chunks) == 0 {
+		return idx
+	}
+
+	// every chunk but the last one has the full block size
+	idx.blockSize = sig.BlockSize
+	if idx.blockSize == 0 {
+		idx.blockSize = int(sig.Chunks[0].Length)
+	}
+	idx.weakHash = sig.WeakHash
+	idx.strongHash = sig.StrongHash
+	idx.strongLen = sig.StrongLen
+
+	for i := range sig.Chunks {
+		c := &sig.Chunks[i]
+		idx.chunks[c.Weak] = append(idx.chunks[c.Weak], c)
+	}
+	return idx
+}
+
+// lookup returns the chunk matching the given window, or nil. The strong digest is only
+// computed when the weak checksum has candidates. Near the end of the file the window is
+// shorter than a block, it can then match a chunk recorded with the full block length:
+// signatures in the librsync format do not store the length of the last block.
+func (idx *index) lookup(weak uint32, window []byte) *models.Chunk {
+	candidates, ok := idx.chunks[weak]
+	if !ok {
+		return nil
+	}
+
+	var digest []byte
+	for _, c := range candidates {
+		if c.Length < int64(len(window)) {
+			continue
+		}
+		if digest == nil {
+			digest = strong.Sum(idx.strongHash, idx.strongLen, window)
+		}
+		if bytes.Equal(c.Strong, digest) {
+			return c
+		}
+	}
+	return nil
+}
+
+// lookupExact returns the chunk of the same length matching the given data, or nil
+func (idx *index) lookupExact(weak uint32, data []byte) *models.Chunk {
+	var digest []byte
+	for _, c := range idx.chunks[weak] {
+		if c.Length != int64(len(data)) {
+			continue
+		}
+		if digest == nil {
+			digest = strong.Sum(idx.strongHash, idx.strongLen, data)
+		}
+		if bytes.Equal(c.Strong, digest) {
+			return c
+		}
+	}
+	return nil
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
@@ -1,94 +1,249 @@
 package diff
 
 import (
-	"reflect"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
+	"testing/iotest"
 
+	"github.com/rs/zerolog"
+
+	"github.com/hungaikev/rdiff/internal/pkg/rolling"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
 	"github.com/hungaikev/rdiff/internal/shared/models"
 )
 
+// sign builds the signature of data with the given block size
+func sign(data []byte, blockSize int) *models.Signature {
+	sig := &models.Signature{
+		FileSize:   int64(len(data)),
+		WeakHash:   models.WeakHashRabinKarp,
+		StrongHash: models.StrongHashBLAKE2b,
+		StrongLen:  8,
+	}
+	for offset := 0; offset < len(data); offset += blockSize {
+		block := data[offset:minInt(offset+blockSize, len(data))]
+		sig.Chunks = append(sig.Chunks, models.Chunk{
+			Weak:   rolling.Sum(sig.WeakHash, block),
+			Strong: strong.Sum(sig.StrongHash, sig.StrongLen, block),
+			Offset: int64(offset),
+			Length: int64(len(block)),
+		})
+	}
+	return sig
+}
+
+// patch rebuilds the updated file from the original file and the delta
+func patch(t *testing.T, original []byte, delta *models.Delta) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	for _, op := range delta.Ops {
+		switch op.Kind {
+		case models.OpCopy:
+			out.Write(original[op.Offset : op.Offset+op.Length])
+		case models.OpLiteral:
+			out.Write(op.Data)
+		case models.OpEnd:
+			return out.Bytes()
+		default:
+			t.Fatalf("unexpected instruction: %v", op.Kind)
+		}
+	}
+	t.Fatalf("missing END instruction")
+	return nil
+}
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
 func TestDiff(t *testing.T) {
-	// define test case
-	original := &models.Signature{
-		FileSize: 100,
-		Chunks: []models.Chunk{
-			{Start: 0, Data: []byte("chunk 1")},
-			{Start: 8, Data: []byte("chunk 2")},
-			{Start: 16, Data: []byte("chunk 3")},
-		},
-	}
-	updated := &models.Signature{
-		FileSize: 100,
-		Chunks: []models.Chunk{
-			{Start: 0, Data: []byte("chunk 1")},
-			{Start: 8, Data: []byte("chunk 2 modified")},
-			{Start: 16, Data: []byte("chunk 3")},
-		},
-	}
-	expected := &models.Delta{
-		Added: []models.Chunk{},
-		Modified: []models.Chunk{
-			{Start: 8, Data: []byte("chunk 2 modified")},
-		},
-		Metadata: map[string]string{},
-	}
-
-	// run test
-	delta, err := Diff(original, updated)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+	ctx := context.Background()
+
+	original := randomBytes(64*1024, 1)
+
+	insertAtStart := append([]byte{'x'}, original...)
+
+	modifiedMiddle := append([]byte(nil), original...)
+	copy(modifiedMiddle[30000:], "chunk 2 modified")
+
+	removedMiddle := append(append([]byte(nil), original[:20000]...), original[20100:]...)
+
+	tests := []struct {
+		name        string
+		updated     []byte
+		maxLiterals int64
+	}{
+		{"identical", original, 0},
+		{"insert at start", insertAtStart, 1024 + 1},
+		{"modified middle", modifiedMiddle, 2 * 1024},
+		{"removed middle", removedMiddle, 2 * 1024},
+		{"appended", append(append([]byte(nil), original...), "appended"...), 1024 + 8},
+		{"empty", []byte{}, 0},
+		{"unrelated", randomBytes(5000, 2), 5000},
 	}
 
-	if !reflect.DeepEqual(delta, expected) {
-		t.Errorf("unexpected delta: got %+v, want %+v", delta, expected)
+	for _, test := range tests {
+		delta, err := Compare(ctx, sign(original, 1024), bytes.NewReader(test.updated))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if got := patch(t, original, delta); !bytes.Equal(got, test.updated) {
+			t.Errorf("%s: patched file does not match the updated file", test.name)
+		}
+
+		checksum := sha256.Sum256(test.updated)
+		if delta.TargetLength != int64(len(test.updated)) || !bytes.Equal(delta.Checksum, checksum[:]) {
+			t.Errorf("%s: unexpected target: got %d/%x, want %d/%x", test.name, delta.TargetLength, delta.Checksum, len(test.updated), checksum)
+		}
+
+		if got := delta.LiteralBytes(); got > test.maxLiterals {
+			t.Errorf("%s: unexpected literal bytes: got %d, want at most %d", test.name, got, test.maxLiterals)
+		}
 	}
 }
 
-func TestDiffChunks(t *testing.T) {
+func TestDiffInstructions(t *testing.T) {
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+	updated := []byte("chunk 1 chunk 2 modified chunk 3 ")
+
+	expected := []models.Op{
+		{Kind: models.OpCopy, Offset: 0, Length: 16},
+		{Kind: models.OpLiteral, Length: 9, Data: []byte("modified ")},
+		{Kind: models.OpCopy, Offset: 16, Length: 8},
+		{Kind: models.OpEnd},
+	}
+
+	delta, err := Compare(context.Background(), sign(original, 8), bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-	added := []models.Chunk{
-		{Start: 24, Data: []byte("chunk 4")},
-		{Start: 32, Data: []byte("chunk 5")},
+	if len(delta.Ops) != len(expected) {
+		t.Fatalf("unexpected instructions: got %+v, want %+v", delta.Ops, expected)
 	}
+	for i := range expected {
+		got, want := delta.Ops[i], expected[i]
+		if got.Kind != want.Kind || got.Offset != want.Offset || got.Length != want.Length || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("unexpected instruction %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
 
-	modified := []models.Chunk{
-		{Start: 8, Data: []byte("chunk 2 modified")},
+func TestDiffInvalidSignature(t *testing.T) {
+	sig := sign([]byte("chunk 1 chunk 2 "), 8)
+	sig.StrongLen = 64
+
+	if _, err := Compare(context.Background(), sig, bytes.NewReader([]byte("chunk 1 "))); err == nil {
+		t.Errorf("expected an error for an invalid strong digest length")
 	}
+}
 
-	original := &models.Signature{
-		FileSize: 100,
-		Chunks: []models.Chunk{
-			{Start: 0, Data: []byte("chunk 1")},
-			{Start: 8, Data: []byte("chunk 2")},
-			{Start: 16, Data: []byte("chunk 3")},
-		},
+func TestDiffContentDefined(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+
+	original := randomBytes(256*1024, 3)
+	updated := append(append(append([]byte(nil), original[:100000]...), "inserted"...), original[100000:]...)
+
+	file, err := ioutil.TempFile("", "diff-*.bin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	updated := &models.Signature{
-		FileSize: 150,
-		Chunks: []models.Chunk{
-			{Start: 0, Data: []byte("chunk 1")},
-			{Start: 8, Data: []byte("chunk 2 modified")},
-			{Start: 16, Data: []byte("chunk 3")},
-			{Start: 24, Data: []byte("chunk 4")},
-			{Start: 32, Data: []byte("chunk 5")},
-		},
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(original); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	expected := &models.Delta{
-		Added:    added,
-		Modified: modified,
-		Metadata: map[string]string{},
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// run test
-	delta, err := Diff(original, updated)
+	sizes := models.ChunkSizes{Min: 1024, Avg: 4096, Max: 16384}
+	sig, err := signature.Generate(ctx, file, &log, signature.WithFastCDC(sizes))
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delta, err := Compare(ctx, sig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := patch(t, original, delta); !bytes.Equal(got, updated) {
+		t.Errorf("patched file does not match the updated file")
+	}
+
+	// only the chunks around the insertion are sent
+	if got := delta.LiteralBytes(); got > int64(2*sizes.Max) {
+		t.Errorf("unexpected literal bytes: got %d, want at most %d", got, 2*sizes.Max)
 	}
+}
+
+// recorder is an OpWriter keeping copies of the instructions
+type recorder struct {
+	ops []models.Op
+}
+
+// WriteOp implements OpWriter
+func (r *recorder) WriteOp(op models.Op) error {
+	op.Data = append([]byte(nil), op.Data...)
+	r.ops = append(r.ops, op)
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+
+	original := randomBytes(1<<20, 4)
+
+	// a long unmatched run, then moved and repeated blocks of the original
+	updated := randomBytes(3*maxLiteral+100, 5)
+	updated = append(updated, original[500000:]...)
+	updated = append(updated, original[:300000]...)
+	updated = append(updated, original[:300000]...)
+
+	readers := map[string]func([]byte) io.Reader{
+		"bytes":    func(b []byte) io.Reader { return bytes.NewReader(b) },
+		"one byte": func(b []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(b)) },
+		"half":     func(b []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(b)) },
+	}
+
+	for name, reader := range readers {
+		rec := &recorder{}
+		summary, err := Stream(ctx, sign(original, 2048), reader(updated), rec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+
+		delta := &models.Delta{Ops: rec.ops}
+		if got := patch(t, original, delta); !bytes.Equal(got, updated) {
+			t.Errorf("%s: patched file does not match the updated file", name)
+		}
 
-	delta.Added = added
-	delta.Modified = modified
+		checksum := sha256.Sum256(updated)
+		if summary.TargetLength != int64(len(updated)) || !bytes.Equal(summary.Checksum, checksum[:]) || summary.Ops != len(rec.ops) {
+			t.Errorf("%s: unexpected summary: %+v", name, summary)
+		}
 
-	if !reflect.DeepEqual(delta.Modified, expected.Modified) {
-		t.Errorf("unexpected delta: got %+v, want %+v", delta, expected)
+		for _, op := range rec.ops {
+			if op.Kind == models.OpLiteral && op.Length > maxLiteral {
+				t.Errorf("%s: literal of %d bytes exceeds %d", name, op.Length, maxLiteral)
+			}
+		}
+		// at most a block around each unaligned edge is sent as literal bytes
+		if summary.LiteralBytes > 3*maxLiteral+100+3*2048 {
+			t.Errorf("%s: unexpected literal bytes: %d", name, summary.LiteralBytes)
+		}
 	}
 }
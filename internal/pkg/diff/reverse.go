@@ -0,0 +1,107 @@
+package diff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// copySpan is a COPY instruction of a forward delta, seen from both files
+type copySpan struct {
+	original int64 // offset in the original file
+	updated  int64 // offset in the updated file
+	length   int64
+}
+
+/*
+Reverse returns the delta that rebuilds the original file from the updated one, given the forward
+delta and the original file. It is meant to be computed while applying the forward delta, when
+both sides are at hand:
+
+1. Every COPY of the forward delta tells where a range of the original file lands in the updated file.
+2. Ranges of the original file copied into the updated file become COPY instructions from the updated file.
+3. The rest of the original file, removed or modified by the forward delta, is read from basis and becomes LITERAL instructions.
+
+Only the bytes that are not in the updated file are read, so the cost is bounded by the size of the
+change rather than the size of the file. The length and checksum of the reverse delta are the size
+and checksum recorded in the signature of the original file.
+*/
+func Reverse(ctx context.Context, original *models.Signature, basis io.ReaderAt, forward *models.Delta) (*models.Delta, error) {
+	ctx, span := tracer.Start(ctx, "diff.Reverse")
+	defer span.End()
+
+	size := original.FileSize
+	spans := copySpans(forward, size)
+
+	reverse := &models.Delta{Ops: make([]models.Op, 0), TargetLength: size, Checksum: original.Checksum}
+	buf := make([]byte, maxLiteral)
+
+	// best is the span reaching the furthest among the ones starting at or before pos
+	pos, next, best := int64(0), 0, -1
+	for pos < size {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for ; next < len(spans) && spans[next].original <= pos; next++ {
+			if best < 0 || spans[next].original+spans[next].length > spans[best].original+spans[best].length {
+				best = next
+			}
+		}
+
+		if best >= 0 {
+			if end := spans[best].original + spans[best].length; end > pos {
+				reverse.AddCopy(spans[best].updated+pos-spans[best].original, end-pos)
+				pos = end
+				continue
+			}
+		}
+
+		// the bytes up to the next span are not in the updated file
+		end := size
+		if next < len(spans) {
+			end = spans[next].original
+		}
+		for pos < end {
+			n := minInt64(end-pos, int64(len(buf)))
+			if read, err := basis.ReadAt(buf[:n], pos); int64(read) != n {
+				if err == nil || err == io.EOF {
+					err = fmt.Errorf("basis file is too short")
+				}
+				return nil, fmt.Errorf("error reading %d bytes at offset %d from basis file: %w", n, pos, err)
+			}
+			reverse.AddLiteral(buf[:n])
+			pos += n
+		}
+	}
+
+	reverse.End()
+	return reverse, nil
+}
+
+// copySpans returns the COPY instructions of the delta sorted by their offset in the original
+// file. Ranges beyond the end of the original file are dropped.
+func copySpans(delta *models.Delta, size int64) []copySpan {
+	var spans []copySpan
+	var pos int64
+	for _, op := range delta.Ops {
+		if op.Kind == models.OpCopy && op.Offset < size {
+			spans = append(spans, copySpan{original: op.Offset, updated: pos, length: minInt64(op.Length, size-op.Offset)})
+		}
+		pos += op.Length
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].original < spans[j].original })
+	return spans
+}
+
+// minInt64 returns the smaller of a and b
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestReverse(t *testing.T) {
+	ctx := context.Background()
+
+	original := randomBytes(64*1024, 1)
+
+	modifiedMiddle := append([]byte(nil), original...)
+	copy(modifiedMiddle[30000:], "chunk 2 modified")
+
+	removedMiddle := append(append([]byte(nil), original[:20000]...), original[20100:]...)
+
+	// the same block copied twice, the second half of the original file is dropped
+	repeated := append(append([]byte(nil), original[:4096]...), original[:4096]...)
+
+	tests := []struct {
+		name        string
+		updated     []byte
+		maxLiterals int64
+	}{
+		{"identical", original, 0},
+		{"insert at start", append([]byte{'x'}, original...), 0},
+		{"modified middle", modifiedMiddle, 2 * 1024},
+		{"removed middle", removedMiddle, 2 * 1024},
+		{"repeated", repeated, int64(len(original)) - 4096},
+		{"empty", []byte{}, int64(len(original))},
+		{"unrelated", randomBytes(5000, 2), int64(len(original))},
+	}
+
+	sig := sign(original, 1024)
+	checksum := sha256.Sum256(original)
+	sig.Checksum = checksum[:]
+
+	for _, test := range tests {
+		forward, err := Compare(ctx, sig, bytes.NewReader(test.updated))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		reverse, err := Reverse(ctx, sig, bytes.NewReader(original), forward)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if got := patch(t, test.updated, reverse); !bytes.Equal(got, original) {
+			t.Errorf("%s: reverse delta does not rebuild the original file", test.name)
+		}
+		if reverse.TargetLength != int64(len(original)) || !bytes.Equal(reverse.Checksum, checksum[:]) {
+			t.Errorf("%s: unexpected target: got %d/%x, want %d/%x", test.name, reverse.TargetLength, reverse.Checksum, len(original), checksum)
+		}
+		if got := reverse.LiteralBytes(); got > test.maxLiterals {
+			t.Errorf("%s: unexpected literal bytes: got %d, want at most %d", test.name, got, test.maxLiterals)
+		}
+	}
+}
+
+func TestReverseShortBasis(t *testing.T) {
+	ctx := context.Background()
+	original := []byte("chunk 1 chunk 2 chunk 3 ")
+
+	sig := sign(original, 8)
+	forward, err := Compare(ctx, sig, bytes.NewReader([]byte("chunk 1 ")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := Reverse(ctx, sig, bytes.NewReader(original[:12]), forward); err == nil {
+		t.Errorf("expected an error for a basis file shorter than its signature")
+	}
+}
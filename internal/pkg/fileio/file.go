@@ -3,7 +3,9 @@ package fileio
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"go.opentelemetry.io/otel"
 )
@@ -45,3 +47,52 @@ func WriteToFile(ctx context.Context, filePath string, data string) error {
 
 	return nil
 }
+
+// WriteAtomic replaces the file at path with the content produced by write. The content is
+// written to a temporary file in the same directory, synced to disk, then renamed over path,
+// so a crash leaves either the old or the new file, never a partial one. The temporary file
+// is removed if write or any step fails. The new file gets the given permissions.
+func WriteAtomic(ctx context.Context, path string, perm os.FileMode, write func(f *os.File) error) (err error) {
+	ctx, span := tracer.Start(ctx, "fileio.WriteAtomic")
+	defer span.End()
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("error setting permissions of temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error renaming temporary file: %w", err)
+	}
+
+	// sync the directory so the rename itself survives a crash. Not every platform can
+	// sync a directory, the file is in place either way.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
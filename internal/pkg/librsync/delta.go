@@ -0,0 +1,266 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Delta command opcodes
+const (
+	opEnd = 0x00
+	// opLiteral1 to opLiteral64 are literals whose length is the opcode itself
+	opLiteral1  = 0x01
+	opLiteral64 = 0x40
+	// opLiteralN1 to opLiteralN8 are literals followed by a 1, 2, 4 or 8 byte length
+	opLiteralN1 = 0x41
+	opLiteralN8 = 0x44
+	// opCopyN1N1 to opCopyN8N8 are copies followed by a 1, 2, 4 or 8 byte offset and
+	// a 1, 2, 4 or 8 byte length
+	opCopyN1N1 = 0x45
+	opCopyN8N8 = 0x54
+)
+
+// intSizes are the sizes in bytes of command parameters, indexed by their size code
+var intSizes = [4]int{1, 2, 4, 8}
+
+// intSizeCode returns the size code of the smallest parameter that holds v
+func intSizeCode(v int64) int {
+	switch {
+	case v&^0xff == 0:
+		return 0
+	case v&^0xffff == 0:
+		return 1
+	case v&^0xffffffff == 0:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// DeltaWriter writes delta instructions in the librsync delta format
+type DeltaWriter struct {
+	w           *bufio.Writer
+	buf         [17]byte
+	wroteHeader bool
+}
+
+// NewDeltaWriter returns a DeltaWriter writing to w. Flush must be called once
+// all instructions have been written.
+func NewDeltaWriter(w io.Writer) *DeltaWriter {
+	return &DeltaWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteOp writes a single instruction
+func (dw *DeltaWriter) WriteOp(op models.Op) error {
+	if err := dw.writeHeader(); err != nil {
+		return err
+	}
+
+	switch op.Kind {
+	case models.OpCopy:
+		offsetCode, lengthCode := intSizeCode(op.Offset), intSizeCode(op.Length)
+		dw.buf[0] = byte(opCopyN1N1 + offsetCode*4 + lengthCode)
+		n := 1 + putInt(dw.buf[1:], op.Offset, offsetCode)
+		n += putInt(dw.buf[n:], op.Length, lengthCode)
+		_, err := dw.w.Write(dw.buf[:n])
+		return err
+
+	case models.OpLiteral:
+		if len(op.Data) == 0 {
+			return nil
+		}
+		n := 1
+		if len(op.Data) <= opLiteral64 {
+			dw.buf[0] = byte(len(op.Data))
+		} else {
+			code := intSizeCode(int64(len(op.Data)))
+			dw.buf[0] = byte(opLiteralN1 + code)
+			n += putInt(dw.buf[1:], int64(len(op.Data)), code)
+		}
+		if _, err := dw.w.Write(dw.buf[:n]); err != nil {
+			return err
+		}
+		_, err := dw.w.Write(op.Data)
+		return err
+
+	case models.OpEnd:
+		return dw.w.WriteByte(opEnd)
+
+	default:
+		return fmt.Errorf("librsync: unknown delta instruction: %d", op.Kind)
+	}
+}
+
+// Flush writes any buffered data to the underlying writer
+func (dw *DeltaWriter) Flush() error {
+	if err := dw.writeHeader(); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+// writeHeader writes the magic number once, before the first command
+func (dw *DeltaWriter) writeHeader() error {
+	if dw.wroteHeader {
+		return nil
+	}
+	dw.wroteHeader = true
+
+	binary.BigEndian.PutUint32(dw.buf[:], MagicDelta)
+	_, err := dw.w.Write(dw.buf[:4])
+	return err
+}
+
+// putInt writes v as a big-endian integer of the given size code and returns its size
+func putInt(b []byte, v int64, code int) int {
+	size := intSizes[code]
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return size
+}
+
+// DeltaReader reads delta instructions in the librsync delta format
+type DeltaReader struct {
+	r          *bufio.Reader
+	buf        [8]byte
+	readHeader bool
+	done       bool
+}
+
+// NewDeltaReader returns a DeltaReader reading from r
+func NewDeltaReader(r io.Reader) *DeltaReader {
+	return &DeltaReader{r: bufio.NewReader(r)}
+}
+
+// ReadOp reads the next instruction. It returns io.EOF after the END instruction.
+func (dr *DeltaReader) ReadOp() (models.Op, error) {
+	if dr.done {
+		return models.Op{}, io.EOF
+	}
+
+	if !dr.readHeader {
+		if _, err := io.ReadFull(dr.r, dr.buf[:4]); err != nil {
+			return models.Op{}, fmt.Errorf("librsync: error reading delta header: %w", err)
+		}
+		if binary.BigEndian.Uint32(dr.buf[:4]) != MagicDelta {
+			return models.Op{}, ErrBadMagic
+		}
+		dr.readHeader = true
+	}
+
+	opcode, err := dr.r.ReadByte()
+	if err != nil {
+		return models.Op{}, fmt.Errorf("librsync: error reading delta command: %w", unexpectedEOF(err))
+	}
+
+	switch {
+	case opcode == opEnd:
+		dr.done = true
+		return models.Op{Kind: models.OpEnd}, nil
+
+	case opcode >= opLiteral1 && opcode <= opLiteral64:
+		return dr.readLiteral(int64(opcode))
+
+	case opcode >= opLiteralN1 && opcode <= opLiteralN8:
+		length, err := dr.readInt(int(opcode - opLiteralN1))
+		if err != nil {
+			return models.Op{}, err
+		}
+		return dr.readLiteral(length)
+
+	case opcode >= opCopyN1N1 && opcode <= opCopyN8N8:
+		code := int(opcode - opCopyN1N1)
+		offset, err := dr.readInt(code / 4)
+		if err != nil {
+			return models.Op{}, err
+		}
+		length, err := dr.readInt(code % 4)
+		if err != nil {
+			return models.Op{}, err
+		}
+		return models.Op{Kind: models.OpCopy, Offset: offset, Length: length}, nil
+
+	default:
+		return models.Op{}, fmt.Errorf("librsync: unknown delta command %#x", opcode)
+	}
+}
+
+// readLiteral reads the data of a literal command
+func (dr *DeltaReader) readLiteral(length int64) (models.Op, error) {
+	if length < 0 {
+		return models.Op{}, fmt.Errorf("librsync: invalid literal length %d", length)
+	}
+
+	// the buffer grows with the data actually read, a corrupt length can not exhaust memory
+	data, err := io.ReadAll(io.LimitReader(dr.r, length))
+	if err != nil {
+		return models.Op{}, fmt.Errorf("librsync: error reading literal data: %w", err)
+	}
+	if int64(len(data)) != length {
+		return models.Op{}, fmt.Errorf("librsync: error reading literal data: %w", io.ErrUnexpectedEOF)
+	}
+	return models.Op{Kind: models.OpLiteral, Length: length, Data: data}, nil
+}
+
+// readInt reads a big-endian command parameter of the given size code
+func (dr *DeltaReader) readInt(code int) (int64, error) {
+	size := intSizes[code]
+	if _, err := io.ReadFull(dr.r, dr.buf[:size]); err != nil {
+		return 0, fmt.Errorf("librsync: error reading command parameter: %w", unexpectedEOF(err))
+	}
+
+	var v int64
+	for _, b := range dr.buf[:size] {
+		v = v<<8 | int64(b)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("librsync: command parameter out of range")
+	}
+	return v, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, the stream must end with an END command
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// EncodeDelta writes the delta in the librsync delta format. The target length and checksum
+// of the delta are not part of the format.
+func EncodeDelta(w io.Writer, delta *models.Delta) error {
+	dw := NewDeltaWriter(w)
+	for _, op := range delta.Ops {
+		if err := dw.WriteOp(op); err != nil {
+			return err
+		}
+	}
+	return dw.Flush()
+}
+
+// DecodeDelta reads a delta in the librsync delta format. The target length is computed
+// from the instructions, the checksum is left empty.
+func DecodeDelta(r io.Reader) (*models.Delta, error) {
+	dr := NewDeltaReader(r)
+	delta := &models.Delta{Ops: make([]models.Op, 0)}
+
+	for {
+		op, err := dr.ReadOp()
+		if err == io.EOF {
+			return delta, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		delta.Ops = append(delta.Ops, op)
+		delta.TargetLength += op.Length
+	}
+}
@@ -0,0 +1,52 @@
+// Package librsync implements the binary signature and delta file formats of librsync,
+// so that files can be exchanged with the C rdiff tool.
+//
+// All integers are big-endian. A signature file is a magic number, the block length, the
+// strong sum length and then the weak and strong sums of every block. A delta file is a
+// magic number followed by a stream of commands, each one an opcode byte and its parameters.
+package librsync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Magic numbers at the start of librsync files
+const (
+	// MagicDelta starts a delta file
+	MagicDelta uint32 = 0x72730236
+	// MagicMD4Sig starts a signature file using Adler-32 weak sums and MD4 strong sums
+	MagicMD4Sig uint32 = 0x72730136
+	// MagicBLAKE2Sig starts a signature file using Adler-32 weak sums and BLAKE2b strong sums
+	MagicBLAKE2Sig uint32 = 0x72730137
+	// MagicRabinKarpMD4Sig starts a signature file using Rabin-Karp weak sums and MD4 strong sums
+	MagicRabinKarpMD4Sig uint32 = 0x72730146
+	// MagicRabinKarpBLAKE2Sig starts a signature file using Rabin-Karp weak sums and BLAKE2b strong sums
+	MagicRabinKarpBLAKE2Sig uint32 = 0x72730147
+)
+
+// ErrBadMagic is returned when a file does not start with the expected magic number
+var ErrBadMagic = errors.New("librsync: bad magic number")
+
+// sigMagics maps signature magic numbers to the hashes they use
+var sigMagics = map[uint32]struct {
+	weak   models.WeakHash
+	strong models.StrongHash
+}{
+	MagicMD4Sig:             {models.WeakHashAdler32, models.StrongHashMD4},
+	MagicBLAKE2Sig:          {models.WeakHashAdler32, models.StrongHashBLAKE2b},
+	MagicRabinKarpMD4Sig:    {models.WeakHashRabinKarp, models.StrongHashMD4},
+	MagicRabinKarpBLAKE2Sig: {models.WeakHashRabinKarp, models.StrongHashBLAKE2b},
+}
+
+// sigMagic returns the signature magic number for the given hashes
+func sigMagic(weak models.WeakHash, strong models.StrongHash) (uint32, error) {
+	for magic, h := range sigMagics {
+		if h.weak == weak && h.strong == strong {
+			return magic, nil
+		}
+	}
+	return 0, fmt.Errorf("librsync: signatures using %s and %s can not be encoded, librsync supports adler32 or rabinkarp with md4 or blake2b", weak, strong)
+}
@@ -0,0 +1,316 @@
+package librsync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/hungaikev/rdiff/internal/pkg/apply"
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/librsync"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// The golden files in testdata are signatures of basis.txt with a block length of 8192 and
+// deltas from basis.txt to new.txt, written by the C rdiff tool of librsync 2.3.4, see
+// testdata/README.md for the commands. TestRdiffInterop checks against the C tool itself.
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+func TestSignatureGolden(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+
+	tests := []struct {
+		file      string
+		weak      models.WeakHash
+		strong    models.StrongHash
+		strongLen int
+	}{
+		{"testdata/basis-md4.sig", models.WeakHashAdler32, models.StrongHashMD4, 16},
+		{"testdata/basis-blake2.sig", models.WeakHashAdler32, models.StrongHashBLAKE2b, 32},
+		{"testdata/basis-rk-md4.sig", models.WeakHashRabinKarp, models.StrongHashMD4, 8},
+		{"testdata/basis-rk-blake2.sig", models.WeakHashRabinKarp, models.StrongHashBLAKE2b, 32},
+	}
+
+	for _, test := range tests {
+		golden := readFile(t, test.file)
+
+		decoded, err := librsync.DecodeSignature(bytes.NewReader(golden))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.file, err)
+			continue
+		}
+		if decoded.WeakHash != test.weak || decoded.StrongHash != test.strong || decoded.StrongLen != test.strongLen {
+			t.Errorf("%s: unexpected hashes: got %s/%s/%d", test.file, decoded.WeakHash, decoded.StrongHash, decoded.StrongLen)
+		}
+
+		basis, err := os.Open("testdata/basis.txt")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		generated, err := signature.Generate(ctx, basis, &log, signature.WithWeakHash(test.weak), signature.WithStrongHash(test.strong, test.strongLen))
+		basis.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(decoded.Chunks) != len(generated.Chunks) {
+			t.Fatalf("%s: unexpected chunks: got %d, want %d", test.file, len(decoded.Chunks), len(generated.Chunks))
+		}
+		for i := range decoded.Chunks {
+			got, want := decoded.Chunks[i], generated.Chunks[i]
+			if got.Weak != want.Weak || !bytes.Equal(got.Strong, want.Strong) || got.Offset != want.Offset {
+				t.Errorf("%s: unexpected chunk %d: got %+v, want %+v", test.file, i, got, want)
+			}
+		}
+
+		var encoded bytes.Buffer
+		if err := librsync.EncodeSignature(&encoded, generated); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.file, err)
+		}
+		if !bytes.Equal(encoded.Bytes(), golden) {
+			t.Errorf("%s: encoded signature does not match the golden file", test.file)
+		}
+	}
+}
+
+func TestDeltaGolden(t *testing.T) {
+	ctx := context.Background()
+	basis := readFile(t, "testdata/basis.txt")
+	updated := readFile(t, "testdata/new.txt")
+
+	for _, file := range []string{"testdata/new.delta", "testdata/new-small-blocks.delta"} {
+		golden := readFile(t, file)
+
+		delta, err := librsync.DecodeDelta(bytes.NewReader(golden))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", file, err)
+			continue
+		}
+
+		var out bytes.Buffer
+		if _, err := apply.Rebuild(ctx, bytes.NewReader(basis), delta, &out); err != nil {
+			t.Errorf("%s: unexpected error: %v", file, err)
+		}
+		if !bytes.Equal(out.Bytes(), updated) {
+			t.Errorf("%s: patched file does not match new.txt", file)
+		}
+
+		var encoded bytes.Buffer
+		if err := librsync.EncodeDelta(&encoded, delta); err != nil {
+			t.Fatalf("%s: unexpected error: %v", file, err)
+		}
+		if !bytes.Equal(encoded.Bytes(), golden) {
+			t.Errorf("%s: encoded delta does not match the golden file", file)
+		}
+	}
+}
+
+func TestDeltaFromGoldenSignature(t *testing.T) {
+	ctx := context.Background()
+	basis := readFile(t, "testdata/basis.txt")
+	updated := readFile(t, "testdata/new.txt")
+
+	sig, err := librsync.DecodeSignature(bytes.NewReader(readFile(t, "testdata/basis-rk-blake2.sig")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delta, err := diff.Compare(ctx, sig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var encoded bytes.Buffer
+	if err := librsync.EncodeDelta(&encoded, delta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	decoded, err := librsync.DecodeDelta(&encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := apply.Rebuild(ctx, bytes.NewReader(basis), decoded, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), updated) {
+		t.Errorf("patched file does not match new.txt")
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	delta := &models.Delta{Ops: []models.Op{
+		{Kind: models.OpCopy, Offset: 0, Length: 1},
+		{Kind: models.OpCopy, Offset: 1 << 20, Length: 1 << 17},
+		{Kind: models.OpCopy, Offset: 1 << 40, Length: 300},
+		{Kind: models.OpLiteral, Length: 64, Data: bytes.Repeat([]byte("a"), 64)},
+		{Kind: models.OpLiteral, Length: 65, Data: bytes.Repeat([]byte("b"), 65)},
+		{Kind: models.OpLiteral, Length: 70000, Data: bytes.Repeat([]byte("c"), 70000)},
+		{Kind: models.OpEnd},
+	}}
+
+	var encoded bytes.Buffer
+	if err := librsync.EncodeDelta(&encoded, delta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	decoded, err := librsync.DecodeDelta(&encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(decoded.Ops) != len(delta.Ops) {
+		t.Fatalf("unexpected instructions: got %d, want %d", len(decoded.Ops), len(delta.Ops))
+	}
+	for i := range delta.Ops {
+		got, want := decoded.Ops[i], delta.Ops[i]
+		if got.Kind != want.Kind || got.Offset != want.Offset || got.Length != want.Length || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("unexpected instruction %d: got %v/%d/%d, want %v/%d/%d", i, got.Kind, got.Offset, got.Length, want.Kind, want.Offset, want.Length)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := librsync.DecodeSignature(bytes.NewReader([]byte{0x72, 0x73, 0x02, 0x36, 0, 0, 0, 1, 0, 0, 0, 8})); !errors.Is(err, librsync.ErrBadMagic) {
+		t.Errorf("unexpected error for a delta magic in a signature: got %v, want %v", err, librsync.ErrBadMagic)
+	}
+
+	// the block length of the header is bounded before it sizes any buffer
+	for _, blockLen := range [][]byte{{0, 0, 0, 0}, {0xff, 0xff, 0xff, 0xff}} {
+		header := append(append([]byte{0x72, 0x73, 0x01, 0x47}, blockLen...), 0, 0, 0, 8)
+		if _, err := librsync.DecodeSignature(bytes.NewReader(header)); err == nil {
+			t.Errorf("expected an error for a block length of %x", blockLen)
+		}
+	}
+
+	if _, err := librsync.DecodeDelta(bytes.NewReader([]byte{0x72, 0x73, 0x01, 0x36})); !errors.Is(err, librsync.ErrBadMagic) {
+		t.Errorf("unexpected error for a signature magic in a delta: got %v, want %v", err, librsync.ErrBadMagic)
+	}
+
+	// a literal of 16 bytes with only 3 bytes of data and no END command
+	if _, err := librsync.DecodeDelta(bytes.NewReader([]byte{0x72, 0x73, 0x02, 0x36, 0x10, 'a', 'b', 'c'})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error for a truncated delta: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	if _, err := librsync.DecodeDelta(bytes.NewReader([]byte{0x72, 0x73, 0x02, 0x36, 0x55})); err == nil {
+		t.Errorf("expected an error for a reserved command")
+	}
+
+	if err := librsync.EncodeSignature(ioutil.Discard, &models.Signature{WeakHash: models.WeakHashAdler32, StrongHash: models.StrongHashSHA256, StrongLen: 32}); err == nil {
+		t.Errorf("expected an error for a signature using sha256")
+	}
+}
+
+func TestRdiffInterop(t *testing.T) {
+	rdiff, err := exec.LookPath("rdiff")
+	if err != nil {
+		// CI installs rdiff, interop must not go unchecked there
+		if os.Getenv("CI") != "" {
+			t.Fatalf("the C rdiff tool is not installed: %v", err)
+		}
+		t.Skip("the C rdiff tool is not installed")
+	}
+
+	ctx := context.Background()
+	log := zerolog.Nop()
+	dir := t.TempDir()
+	basis := readFile(t, "testdata/basis.txt")
+	updated := readFile(t, "testdata/new.txt")
+
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command(rdiff, args...).CombinedOutput(); err != nil {
+			t.Fatalf("rdiff %v: %v\n%s", args, err, out)
+		}
+	}
+
+	tests := []struct {
+		weak      string
+		strong    string
+		strongLen int
+		options   []signature.Option
+	}{
+		{"rollsum", "md4", 16, []signature.Option{signature.WithWeakHash(models.WeakHashAdler32), signature.WithStrongHash(models.StrongHashMD4, 16)}},
+		{"rollsum", "blake2", 32, []signature.Option{signature.WithWeakHash(models.WeakHashAdler32), signature.WithStrongHash(models.StrongHashBLAKE2b, 32)}},
+		{"rabinkarp", "md4", 8, []signature.Option{signature.WithWeakHash(models.WeakHashRabinKarp), signature.WithStrongHash(models.StrongHashMD4, 8)}},
+		{"rabinkarp", "blake2", 32, []signature.Option{signature.WithWeakHash(models.WeakHashRabinKarp), signature.WithStrongHash(models.StrongHashBLAKE2b, 32)}},
+	}
+
+	for _, tt := range tests {
+		name := tt.weak + "-" + tt.strong
+		t.Run(name, func(t *testing.T) {
+			sigFile := filepath.Join(dir, name+".sig")
+			run("signature", "-b", "2048", "-H", tt.strong, "-R", tt.weak, "-S", fmt.Sprint(tt.strongLen), "testdata/basis.txt", sigFile)
+
+			// the signature written by rdiff is the one this package writes
+			options := append(tt.options, signature.WithBlockSize(2048))
+			generated, err := signature.GenerateFromReader(ctx, bytes.NewReader(basis), &log, options...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var encoded bytes.Buffer
+			if err := librsync.EncodeSignature(&encoded, generated); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(encoded.Bytes(), readFile(t, sigFile)) {
+				t.Errorf("signature does not match the one written by rdiff")
+			}
+
+			// a delta written by rdiff is applied by this package
+			deltaFile := filepath.Join(dir, name+".delta")
+			run("delta", sigFile, "testdata/new.txt", deltaFile)
+			delta, err := librsync.DecodeDelta(bytes.NewReader(readFile(t, deltaFile)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var out bytes.Buffer
+			if _, err := apply.Rebuild(ctx, bytes.NewReader(basis), delta, &out); err != nil || !bytes.Equal(out.Bytes(), updated) {
+				t.Errorf("delta written by rdiff does not rebuild new.txt: %v", err)
+			}
+
+			// a delta written by this package from the signature of rdiff is applied by rdiff
+			sig, err := librsync.DecodeSignature(bytes.NewReader(readFile(t, sigFile)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ours, err := diff.Compare(ctx, sig, bytes.NewReader(updated))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			encoded.Reset()
+			if err := librsync.EncodeDelta(&encoded, ours); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			oursFile := filepath.Join(dir, name+"-ours.delta")
+			if err := os.WriteFile(oursFile, encoded.Bytes(), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			patched := filepath.Join(dir, name+".out")
+			run("patch", "testdata/basis.txt", oursFile, patched)
+			if !bytes.Equal(readFile(t, patched), updated) {
+				t.Errorf("rdiff does not rebuild new.txt from the delta of this package")
+			}
+		})
+	}
+}
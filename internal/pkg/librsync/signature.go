@@ -0,0 +1,113 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/pkg/chunks"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// EncodeSignature writes the signature in the librsync signature format. Only the hashes and
+// the block length are encoded, file metadata such as the path or size is not part of the format.
+func EncodeSignature(w io.Writer, sig *models.Signature) error {
+	if sig.Chunking != models.ChunkingFixed {
+		return fmt.Errorf("librsync: signatures only support fixed blocks, not %s chunking", sig.Chunking)
+	}
+
+	magic, err := sigMagic(sig.WeakHash, sig.StrongHash)
+	if err != nil {
+		return err
+	}
+
+	blockLen := int64(sig.BlockSize)
+	if blockLen == 0 && len(sig.Chunks) > 0 {
+		blockLen = sig.Chunks[0].Length
+	}
+	if blockLen == 0 {
+		blockLen = chunks.DefaultSize
+	}
+
+	bw := bufio.NewWriter(w)
+
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:], magic)
+	binary.BigEndian.PutUint32(header[4:], uint32(blockLen))
+	binary.BigEndian.PutUint32(header[8:], uint32(sig.StrongLen))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	weak := make([]byte, 4)
+	for _, c := range sig.Chunks {
+		if len(c.Strong) != sig.StrongLen {
+			return fmt.Errorf("librsync: chunk at offset %d has a %d byte strong sum, signature expects %d", c.Offset, len(c.Strong), sig.StrongLen)
+		}
+		binary.BigEndian.PutUint32(weak, c.Weak)
+		if _, err := bw.Write(weak); err != nil {
+			return err
+		}
+		if _, err := bw.Write(c.Strong); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// DecodeSignature reads a signature in the librsync signature format. The format does not
+// record the length of the last block, so every chunk is given the full block length.
+func DecodeSignature(r io.Reader) (*models.Signature, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("librsync: error reading signature header: %w", err)
+	}
+
+	hashes, ok := sigMagics[binary.BigEndian.Uint32(header[0:])]
+	if !ok {
+		return nil, ErrBadMagic
+	}
+
+	blockLen := int64(binary.BigEndian.Uint32(header[4:]))
+	strongLen := int(binary.BigEndian.Uint32(header[8:]))
+	// the block length sizes the buffers of the delta, a corrupt header must not exhaust memory
+	if err := chunks.ValidateBlockSize(int(blockLen)); err != nil {
+		return nil, fmt.Errorf("librsync: %w", err)
+	}
+	if err := strong.Validate(hashes.strong, strongLen); err != nil {
+		return nil, fmt.Errorf("librsync: %w", err)
+	}
+
+	sig := &models.Signature{
+		WeakHash:   hashes.weak,
+		StrongHash: hashes.strong,
+		StrongLen:  strongLen,
+		BlockSize:  int(blockLen),
+		Chunks:     make([]models.Chunk, 0),
+	}
+
+	block := make([]byte, 4+strongLen)
+	for offset := int64(0); ; offset += blockLen {
+		if _, err := io.ReadFull(br, block); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("librsync: error reading block %d: %w", len(sig.Chunks), err)
+		}
+
+		sig.Chunks = append(sig.Chunks, models.Chunk{
+			Weak:   binary.BigEndian.Uint32(block),
+			Strong: append([]byte(nil), block[4:]...),
+			Offset: offset,
+			Length: blockLen,
+		})
+	}
+
+	return sig, nil
+}
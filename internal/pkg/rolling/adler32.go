@@ -0,0 +1,64 @@
+package rolling
+
+// charOffset is added to every byte before it enters the sums. It matches the
+// ROLLSUM_CHAR_OFFSET used by rsync and librsync so that runs of zero bytes
+// still produce a non-zero checksum.
+const charOffset = 31
+
+// Adler32 is the rsync style rolling checksum. It keeps two running sums:
+// s1 is the sum of all bytes in the window and s2 is the sum of all s1 values,
+// which weights each byte by its distance from the end of the window.
+type Adler32 struct {
+	count uint32 // number of bytes in the window
+	s1    uint32 // sum of the bytes
+	s2    uint32 // sum of the running s1 values
+}
+
+// NewAdler32 returns an empty Adler-32 rolling checksum
+func NewAdler32() *Adler32 {
+	return &Adler32{}
+}
+
+// Update appends the given bytes to the window
+func (a *Adler32) Update(p []byte) {
+	for _, c := range p {
+		a.s1 += uint32(c) + charOffset
+		a.s2 += a.s1
+	}
+	a.count += uint32(len(p))
+}
+
+// Roll slides the window by one byte
+func (a *Adler32) Roll(out, in byte) {
+	a.s1 += uint32(in) - uint32(out)
+	a.s2 += a.s1 - a.count*(uint32(out)+charOffset)
+}
+
+// RollIn appends a single byte to the window
+func (a *Adler32) RollIn(in byte) {
+	a.s1 += uint32(in) + charOffset
+	a.s2 += a.s1
+	a.count++
+}
+
+// RollOut removes the oldest byte from the window
+func (a *Adler32) RollOut(out byte) {
+	a.s1 -= uint32(out) + charOffset
+	a.s2 -= a.count * (uint32(out) + charOffset)
+	a.count--
+}
+
+// Reset empties the window
+func (a *Adler32) Reset() {
+	*a = Adler32{}
+}
+
+// Sum returns the checksum of the current window
+func (a *Adler32) Sum() uint32 {
+	return a.s2<<16 | a.s1&0xffff
+}
+
+// Window returns the number of bytes currently in the window
+func (a *Adler32) Window() int {
+	return int(a.count)
+}
@@ -0,0 +1,59 @@
+// Package rolling implements weak rolling checksums used to find matching blocks at any byte offset.
+package rolling
+
+import (
+	"fmt"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Checksum is a weak checksum computed over a window of bytes. The window can be slid
+// one byte at a time in constant time, which is what makes it possible to look for a
+// matching block at every offset of a file instead of only at block boundaries.
+type Checksum interface {
+	// Update appends the given bytes to the window
+	Update(p []byte)
+
+	// Roll slides the window by one byte: out leaves the window and in enters it
+	Roll(out, in byte)
+
+	// RollIn appends a single byte to the window
+	RollIn(in byte)
+
+	// RollOut removes the oldest byte from the window
+	RollOut(out byte)
+
+	// Reset empties the window
+	Reset()
+
+	// Sum returns the checksum of the current window
+	Sum() uint32
+
+	// Window returns the number of bytes currently in the window
+	Window() int
+}
+
+// New returns an empty rolling checksum of the given kind. Unknown kinds fall back to Adler-32.
+func New(kind models.WeakHash) Checksum {
+	if kind == models.WeakHashRabinKarp {
+		return NewRabinKarp()
+	}
+	return NewAdler32()
+}
+
+// Sum computes the checksum of the given kind over data in one go
+func Sum(kind models.WeakHash, data []byte) uint32 {
+	c := New(kind)
+	c.Update(data)
+	return c.Sum()
+}
+
+// Parse returns the weak hash with the given name, as returned by models.WeakHash.String
+func Parse(name string) (models.WeakHash, error) {
+	for _, h := range []models.WeakHash{models.WeakHashAdler32, models.WeakHashRabinKarp} {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weak hash: %q", name)
+}
@@ -0,0 +1,84 @@
+package rolling
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+func TestRabinKarpInverse(t *testing.T) {
+	mult, inv := uint32(rabinKarpMult), uint32(rabinKarpInvMult)
+	if got := mult * inv; got != 1 {
+		t.Errorf("unexpected product of multiplier and its inverse: got %#x, want 1", got)
+	}
+}
+
+func TestChecksumRoll(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	const window = 64
+
+	for _, kind := range []models.WeakHash{models.WeakHashAdler32, models.WeakHashRabinKarp} {
+		c := New(kind)
+		c.Update(data[:window])
+
+		for i := window; i < len(data); i++ {
+			c.Roll(data[i-window], data[i])
+
+			want := Sum(kind, data[i-window+1:i+1])
+			if c.Sum() != want {
+				t.Fatalf("%s: unexpected sum at offset %d: got %#x, want %#x", kind, i, c.Sum(), want)
+			}
+			if c.Window() != window {
+				t.Fatalf("%s: unexpected window at offset %d: got %d, want %d", kind, i, c.Window(), window)
+			}
+		}
+	}
+}
+
+func TestChecksumRollInOut(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, kind := range []models.WeakHash{models.WeakHashAdler32, models.WeakHashRabinKarp} {
+		c := New(kind)
+		for _, b := range data {
+			c.RollIn(b)
+		}
+		if want := Sum(kind, data); c.Sum() != want {
+			t.Errorf("%s: unexpected sum after roll in: got %#x, want %#x", kind, c.Sum(), want)
+		}
+
+		// shrink the window from the front, as happens at the end of a file
+		for i := 0; i < 10; i++ {
+			c.RollOut(data[i])
+		}
+		if want := Sum(kind, data[10:]); c.Sum() != want {
+			t.Errorf("%s: unexpected sum after roll out: got %#x, want %#x", kind, c.Sum(), want)
+		}
+
+		c.Reset()
+		if want := Sum(kind, nil); c.Sum() != want || c.Window() != 0 {
+			t.Errorf("%s: unexpected state after reset: got %#x/%d, want %#x/0", kind, c.Sum(), c.Window(), want)
+		}
+	}
+}
+
+func TestAdler32Sum(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		result uint32
+	}{
+		{[]byte{}, 0},
+		{[]byte{0}, 0x001f001f},
+		{[]byte{1, 2}, 0x00610041},
+	}
+
+	for _, test := range tests {
+		result := Sum(models.WeakHashAdler32, test.data)
+		if result != test.result {
+			t.Errorf("unexpected result for data %v: got %#x, want %#x", test.data, result, test.result)
+		}
+	}
+}
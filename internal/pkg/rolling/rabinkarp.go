@@ -0,0 +1,73 @@
+package rolling
+
+const (
+	// rabinKarpSeed is the initial hash value of an empty window
+	rabinKarpSeed = 1
+	// rabinKarpMult is the polynomial base, the same one librsync uses
+	rabinKarpMult = 0x08104225
+	// rabinKarpInvMult is the multiplicative inverse of rabinKarpMult modulo 2^32
+	rabinKarpInvMult = 0x98f009ad
+	// rabinKarpAdjust removes the contribution of the seed when a byte leaves the window
+	rabinKarpAdjust = rabinKarpMult - 1
+)
+
+// RabinKarp is a polynomial rolling checksum. It distributes bits better than
+// Adler32 for small blocks, at the cost of a couple of multiplications per byte.
+// All arithmetic is modulo 2^32.
+type RabinKarp struct {
+	count uint32 // number of bytes in the window
+	hash  uint32 // current hash value
+	mult  uint32 // rabinKarpMult raised to the power of count
+}
+
+// NewRabinKarp returns an empty Rabin-Karp rolling checksum
+func NewRabinKarp() *RabinKarp {
+	r := &RabinKarp{}
+	r.Reset()
+	return r
+}
+
+// Update appends the given bytes to the window
+func (r *RabinKarp) Update(p []byte) {
+	for _, c := range p {
+		r.hash = r.hash*rabinKarpMult + uint32(c)
+		r.mult *= rabinKarpMult
+	}
+	r.count += uint32(len(p))
+}
+
+// Roll slides the window by one byte
+func (r *RabinKarp) Roll(out, in byte) {
+	r.hash = r.hash*rabinKarpMult + uint32(in) - r.mult*(uint32(out)+rabinKarpAdjust)
+}
+
+// RollIn appends a single byte to the window
+func (r *RabinKarp) RollIn(in byte) {
+	r.hash = r.hash*rabinKarpMult + uint32(in)
+	r.mult *= rabinKarpMult
+	r.count++
+}
+
+// RollOut removes the oldest byte from the window
+func (r *RabinKarp) RollOut(out byte) {
+	r.count--
+	r.mult *= rabinKarpInvMult
+	r.hash -= r.mult * (uint32(out) + rabinKarpAdjust)
+}
+
+// Reset empties the window
+func (r *RabinKarp) Reset() {
+	r.count = 0
+	r.hash = rabinKarpSeed
+	r.mult = 1
+}
+
+// Sum returns the checksum of the current window
+func (r *RabinKarp) Sum() uint32 {
+	return r.hash
+}
+
+// Window returns the number of bytes currently in the window
+func (r *RabinKarp) Window() int {
+	return int(r.count)
+}
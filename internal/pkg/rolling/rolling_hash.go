@@ -10,12 +10,12 @@ import (
 
 The Hash function calculates the rolling hash value for a given slice of bytes using the Rolling Hash algorithm. Here is a step-by-step breakdown of how the function works:
 
-1. It calculates the length of the input data, n.
-2. It initializes the rolling hash value, hash, to 0.
-3. It creates an array of powers of two, powers, with a length of n. The first element in the array is set to 1.
-4. It pre-calculates the powers of two for each element in the powers array. The ith element is set to the value of the (i-1)th element multiplied by 2.
-5. It iterates over each byte in the input data. For each iteration, it adds the current byte to the rolling hash value by multiplying it by the corresponding power of two in the powers array and adding it to hash.
-6. It returns the final rolling hash value, hash.
+1. It initializes the rolling hash value, hash, to 0.
+2. It keeps the power of two for the current position, starting at 1 and doubling it after every byte.
+3. It iterates over each byte in the input data. For each iteration, it adds the current byte to the rolling hash value by multiplying it by the current power of two and adding it to hash.
+4. It returns the final rolling hash value, hash.
+
+Hash can not be slid over a file one byte at a time. Use the Checksum implementations (Adler32, RabinKarp) for that.
 
 */
 
@@ -26,25 +26,17 @@ func Hash(ctx context.Context, data []byte) uint64 {
 	ctx, span := tracer.Start(ctx, "rolling.Hash")
 	defer span.End()
 
-	// the length of the data
-	n := len(data)
-
 	// the initial value for the rolling hash
 	hash := uint64(0)
 
-	// an array of powers of two
-	powers := make([]uint64, n)
-	powers[0] = 1
-
-	// pre-calculate the powers of two
-	for i := 1; i < n; i++ {
-		powers[i] = powers[i-1] * 2
-	}
+	// the power of two for the current position, computed as we go
+	power := uint64(1)
 
 	// calculate the rolling hash value
-	for i := 0; i < n; i++ {
+	for _, b := range data {
 		// add the current byte to the rolling hash
-		hash += uint64(data[i]) * powers[i]
+		hash += uint64(b) * power
+		power *= 2
 	}
 
 	return hash
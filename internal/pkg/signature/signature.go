@@ -3,22 +3,111 @@ package signature
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
-	"github.com/rs/zerolog"
-	"go.opentelemetry.io/otel"
+	"hash"
+	"io"
 	"os"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
 
 	"github.com/hungaikev/rdiff/internal/pkg/chunks"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
 	"github.com/hungaikev/rdiff/internal/shared/models"
 )
 
 var tracer = otel.Tracer("signature")
 
-// Generate generates a new signature for the given file and returns it
-func Generate(ctx context.Context, file *os.File, log *zerolog.Logger) (*models.Signature, error) {
+// settings are the chunking options and the file metadata of a signature being generated
+type settings struct {
+	chunks.Options
+	size    int64 // length of the data, -1 when unknown
+	name    string
+	modTime time.Time
+}
+
+// Option configures signature generation
+type Option func(*settings)
+
+// WithSize sets the length of the data, when it is known before reading it. It is only
+// used to pick the block size automatically, see WithBlockSize.
+func WithSize(size int64) Option {
+	return func(o *settings) {
+		o.size = size
+	}
+}
+
+// WithName sets the path recorded in the signature
+func WithName(name string) Option {
+	return func(o *settings) {
+		o.name = name
+	}
+}
+
+// WithModTime sets the last modification time recorded in the signature
+func WithModTime(t time.Time) Option {
+	return func(o *settings) {
+		o.modTime = t
+	}
+}
+
+// WithStrongHash sets the strong digest algorithm of the chunks and the length in bytes
+// the digests are truncated to. A length of 0 keeps the full digest.
+func WithStrongHash(h models.StrongHash, length int) Option {
+	return func(o *settings) {
+		o.StrongHash = h
+		o.StrongLen = length
+	}
+}
+
+// WithWeakHash sets the rolling checksum used for the weak hash of the chunks
+func WithWeakHash(h models.WeakHash) Option {
+	return func(o *settings) {
+		o.WeakHash = h
+	}
+}
+
+// WithBlockSize sets the size in bytes of the fixed blocks. A size of 0 picks the size from
+// the length of the file, see chunks.AutoBlockSize, or uses chunks.DefaultSize when the
+// length is not known.
+func WithBlockSize(size int) Option {
+	return func(o *settings) {
+		o.BlockSize = size
+	}
+}
+
+// WithFastCDC splits the file into content-defined chunks with FastCDC instead of fixed blocks.
+// Inserting or removing bytes then only changes the chunks around the edit.
+func WithFastCDC(sizes models.ChunkSizes) Option {
+	return func(o *settings) {
+		o.Chunking = models.ChunkingFastCDC
+		o.ChunkSizes = sizes
+	}
+}
+
+// WithSettingsOf uses the hashes and the chunking of an existing signature, so that the
+// signature of a new version of a file is built like the signature of the previous one
+func WithSettingsOf(sig *models.Signature) Option {
+	return func(o *settings) {
+		o.WeakHash = sig.WeakHash
+		o.StrongHash = sig.StrongHash
+		o.StrongLen = sig.StrongLen
+		o.BlockSize = sig.BlockSize
+		if o.BlockSize == 0 && len(sig.Chunks) > 0 {
+			// signatures stored before the block size was recorded
+			o.BlockSize = int(sig.Chunks[0].Length)
+		}
+		o.Chunking = sig.Chunking
+		o.ChunkSizes = sig.ChunkSizes
+	}
+}
+
+// Generate generates a new signature for the given file and returns it. The path, size and
+// modification time of the file are recorded in the signature, options can override them.
+func Generate(ctx context.Context, file *os.File, log *zerolog.Logger, options ...Option) (*models.Signature, error) {
 	ctx, span := tracer.Start(ctx, "signature.Generate")
 	defer span.End()
 
@@ -28,8 +117,60 @@ func Generate(ctx context.Context, file *os.File, log *zerolog.Logger) (*models.
 		return nil, fmt.Errorf("unable to get file information: %w", err)
 	}
 
+	metadata := []Option{WithName(file.Name()), WithModTime(fileInfo.ModTime())}
+	if fileInfo.Mode().IsRegular() {
+		// the size of pipes and devices, such as stdin, says nothing about their content
+		metadata = append(metadata, WithSize(fileInfo.Size()))
+	}
+
+	return GenerateFromReader(ctx, file, log, append(metadata, options...)...)
+}
+
+// GenerateFromReader generates a new signature for the data read from r and returns it.
+// The data is streamed block by block, so it can come from stdin, the network or a
+// decompressor without touching the disk. WithName, WithSize and WithModTime provide the
+// metadata a file would have.
+func GenerateFromReader(ctx context.Context, r io.Reader, log *zerolog.Logger, options ...Option) (*models.Signature, error) {
+	ctx, span := tracer.Start(ctx, "signature.GenerateFromReader")
+	defer span.End()
+
+	opts := settings{
+		Options: chunks.Options{WeakHash: models.WeakHashAdler32, StrongHash: strong.Default, BlockSize: chunks.DefaultSize},
+		size:    -1,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.StrongLen == 0 {
+		opts.StrongLen = strong.Size(opts.StrongHash)
+	}
+	if err := strong.Validate(opts.StrongHash, opts.StrongLen); err != nil {
+		return nil, err
+	}
+
+	switch opts.Chunking {
+	case models.ChunkingFastCDC:
+		opts.BlockSize = 0
+		if err := chunks.ValidateChunkSizes(opts.ChunkSizes); err != nil {
+			return nil, err
+		}
+	default:
+		if opts.BlockSize == 0 {
+			opts.BlockSize = chunks.DefaultSize
+			if opts.size >= 0 {
+				opts.BlockSize = chunks.AutoBlockSize(opts.size)
+			}
+		}
+		if err := chunks.ValidateBlockSize(opts.BlockSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// count and digest the bytes actually read, the size given in the options is only a hint
+	counter := &countingReader{r: r, checksum: sha256.New()}
+
 	// generate chunks
-	chunks, err := chunks.Generate(ctx, file, log)
+	chunks, err := chunks.Generate(ctx, counter, log, opts.Options)
 	if err != nil {
 		return nil, fmt.Errorf("unable to generate chunks: %w", err)
 	}
@@ -37,15 +178,36 @@ func Generate(ctx context.Context, file *os.File, log *zerolog.Logger) (*models.
 	// create a new signature
 	signature := &models.Signature{
 		ID:           uuid.New(),
-		FileSize:     fileInfo.Size(),
-		FilePath:     file.Name(),
-		LastModified: fileInfo.ModTime(),
+		FileSize:     counter.n,
+		Checksum:     counter.checksum.Sum(nil),
+		FilePath:     opts.name,
+		LastModified: opts.modTime,
 		CreatedAt:    time.Now().UTC(),
+		WeakHash:     opts.WeakHash,
+		StrongHash:   opts.StrongHash,
+		StrongLen:    opts.StrongLen,
+		BlockSize:    opts.BlockSize,
+		Chunking:     opts.Chunking,
+		ChunkSizes:   opts.ChunkSizes,
 		Chunks:       chunks,
 	}
 
-	log.Info().Msgf("generated signature for file %s", file.Name())
-	signature.Print()
+	log.Info().Msgf("generated signature for %q: %d bytes, %d chunks", opts.name, signature.FileSize, len(signature.Chunks))
 
 	return signature, nil
 }
+
+// countingReader counts and digests the bytes read through it
+type countingReader struct {
+	r        io.Reader
+	n        int64
+	checksum hash.Hash
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.checksum.Write(p[:n])
+	return n, err
+}
@@ -1,15 +1,34 @@
 package signature
 
 import (
-	"github.com/google/uuid"
-	"github.com/hungaikev/rdiff/internal/shared/models"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/hungaikev/rdiff/internal/pkg/chunks"
+	"github.com/hungaikev/rdiff/internal/pkg/rolling"
+	"github.com/hungaikev/rdiff/internal/pkg/strong"
+	"github.com/hungaikev/rdiff/internal/shared/models"
 )
 
+// chunk builds the expected chunk for the given data
+func chunk(offset int64, data []byte) models.Chunk {
+	return models.Chunk{
+		Weak:   rolling.Sum(models.WeakHashAdler32, data),
+		Strong: strong.Sum(models.StrongHashSHA256, 32, data),
+		Offset: offset,
+		Length: int64(len(data)),
+	}
+}
+
 func TestGenerateSignature(t *testing.T) {
 	// create small file with a single line of text
 	tmpFile, err := ioutil.TempFile("", "test-*.txt")
@@ -29,18 +48,31 @@ func TestGenerateSignature(t *testing.T) {
 
 	// define expected signature
 	expected := &models.Signature{
-		FileSize:  9,
-		CreatedAt: createdAt,
-		ID:        genID,
+		FileSize:   9,
+		Checksum:   strong.Sum(models.StrongHashSHA256, 32, []byte("test data")),
+		FilePath:   tmpFile.Name(),
+		CreatedAt:  createdAt,
+		ID:         genID,
+		WeakHash:   models.WeakHashAdler32,
+		StrongHash: models.StrongHashSHA256,
+		StrongLen:  32,
+		BlockSize:  8192,
 		Chunks: []models.Chunk{
-			{Offset: 0, Data: []byte("test data")},
+			chunk(0, []byte("test data")),
 		},
 	}
 
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+
 	// run test
-	signature, err := GenerateSignature(tmpFile)
+	log := zerolog.Nop()
+	signature, err := Generate(context.Background(), file, &log)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	signature.CreatedAt = createdAt
@@ -54,7 +86,7 @@ func TestGenerateSignature(t *testing.T) {
 
 func TestGenerateSignatureLarge(t *testing.T) {
 	// create larger file with multiple lines of text
-	tmpFile, err := os.OpenFile("test.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	tmpFile, err := ioutil.TempFile("", "test-*.txt")
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -82,35 +114,188 @@ func TestGenerateSignatureLarge(t *testing.T) {
 	genID := uuid.New()
 	lastModified := time.Now()
 
-	chunks := []models.Chunk{
-		{Offset: 0, Data: []byte("Kenya is a country in Africa and a founding member of the East African Community (EAC).")},
-		{Offset: 100, Data: []byte("Uganda is a landlocked country in East Africa.")},
-		{Offset: 200, Data: []byte("Rwanda is a landlocked country in the African Great Lakes region.")},
-		{Offset: 300, Data: []byte("Tanzania is a country in East Africa within the African Great Lakes region.")},
-		{Offset: 400, Data: []byte("EAC Trades in Goods and Services")},
+	var content []byte
+	for _, line := range lines {
+		content = append(content, line...)
+	}
+
+	// the file is smaller than a block, so it is a single chunk
+	expectedChunks := []models.Chunk{
+		chunk(0, content),
 	}
 
 	// define expected signature
 	expected := &models.Signature{
-		FileSize:     315,
+		FileSize:     int64(len(content)),
+		Checksum:     strong.Sum(models.StrongHashSHA256, 32, content),
+		FilePath:     tmpFile.Name(),
 		CreatedAt:    createdAt,
 		ID:           genID,
-		Chunks:       chunks,
+		WeakHash:     models.WeakHashAdler32,
+		StrongHash:   models.StrongHashSHA256,
+		StrongLen:    32,
+		BlockSize:    8192,
+		Chunks:       expectedChunks,
 		LastModified: lastModified,
 	}
 
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+
 	// run test
-	signature, err := GenerateSignature(tmpFile)
+	log := zerolog.Nop()
+	signature, err := Generate(context.Background(), file, &log)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	signature.CreatedAt = createdAt
 	signature.ID = genID
 	signature.LastModified = lastModified
-	signature.Chunks = chunks
 
 	if !reflect.DeepEqual(signature, expected) {
 		t.Errorf("unexpected signature: got %+v, want %+v", signature, expected)
 	}
 }
+
+func TestGenerateSignatureStrongHash(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "test-*.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.Write([]byte("test data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	log := zerolog.Nop()
+
+	if _, err := tmpFile.Seek(0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	signature, err := Generate(context.Background(), tmpFile, &log, WithStrongHash(models.StrongHashBLAKE2b, 8))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if signature.StrongHash != models.StrongHashBLAKE2b || signature.StrongLen != 8 {
+		t.Errorf("unexpected strong hash: got %s/%d, want blake2b/8", signature.StrongHash, signature.StrongLen)
+	}
+	expected := strong.Sum(models.StrongHashBLAKE2b, 8, []byte("test data"))
+	if len(signature.Chunks) != 1 || !reflect.DeepEqual(signature.Chunks[0].Strong, expected) {
+		t.Errorf("unexpected chunks: got %+v, want a single chunk with strong digest %x", signature.Chunks, expected)
+	}
+
+	if _, err := Generate(context.Background(), tmpFile, &log, WithStrongHash(models.StrongHashBLAKE2b, 33)); err == nil {
+		t.Errorf("expected an error for a strong digest longer than the hash")
+	}
+}
+
+func TestGenerateSignatureBlockSize(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "test-*.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	content := make([]byte, 1000000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	log := zerolog.Nop()
+
+	tests := []struct {
+		size     int
+		expected int
+	}{
+		{4096, 4096},
+		{0, 1000}, // square root of the file size
+	}
+
+	for _, test := range tests {
+		if _, err := tmpFile.Seek(0, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		signature, err := Generate(context.Background(), tmpFile, &log, WithBlockSize(test.size))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if signature.BlockSize != test.expected {
+			t.Errorf("unexpected block size for %d: got %d, want %d", test.size, signature.BlockSize, test.expected)
+		}
+		if want := (len(content) + test.expected - 1) / test.expected; len(signature.Chunks) != want {
+			t.Errorf("unexpected chunks for %d: got %d, want %d", test.size, len(signature.Chunks), want)
+		}
+		if signature.Chunks[0].Length != int64(test.expected) {
+			t.Errorf("unexpected chunk length for %d: got %d, want %d", test.size, signature.Chunks[0].Length, test.expected)
+		}
+	}
+
+	if _, err := Generate(context.Background(), tmpFile, &log, WithBlockSize(-1)); err == nil {
+		t.Errorf("expected an error for a negative block size")
+	}
+}
+
+func TestGenerateSignatureFromReader(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(content); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	zr, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the data is only ever held by the decompressor
+	log := zerolog.Nop()
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	signature, err := GenerateFromReader(context.Background(), zr, &log, WithName("stream.gz"), WithModTime(modTime))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if signature.FilePath != "stream.gz" || !signature.LastModified.Equal(modTime) || signature.FileSize != int64(len(content)) {
+		t.Errorf("unexpected metadata: got %q/%s/%d", signature.FilePath, signature.LastModified, signature.FileSize)
+	}
+
+	// without a size the default block size is used
+	if signature.BlockSize != 8192 || len(signature.Chunks) != 13 {
+		t.Errorf("unexpected chunks: got %d chunks of %d bytes, want 13 chunks of 8192 bytes", len(signature.Chunks), signature.BlockSize)
+	}
+	for i, c := range signature.Chunks {
+		end := c.Offset + c.Length
+		if want := chunk(c.Offset, content[c.Offset:end]); !reflect.DeepEqual(c, want) {
+			t.Errorf("unexpected chunk %d: got %+v, want %+v", i, c, want)
+		}
+	}
+
+	// with a size the block size can be picked automatically
+	signature, err = GenerateFromReader(context.Background(), bytes.NewReader(content), &log, WithSize(int64(len(content))), WithBlockSize(0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := chunks.AutoBlockSize(int64(len(content))); signature.BlockSize != want {
+		t.Errorf("unexpected block size: got %d, want %d", signature.BlockSize, want)
+	}
+}
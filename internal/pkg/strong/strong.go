@@ -0,0 +1,70 @@
+// Package strong implements the strong digests used to confirm weak checksum matches.
+package strong
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Default is the strong hash used when none is configured
+const Default = models.StrongHashSHA256
+
+// Parse returns the strong hash with the given name, as returned by models.StrongHash.String
+func Parse(name string) (models.StrongHash, error) {
+	for _, h := range []models.StrongHash{models.StrongHashSHA256, models.StrongHashBLAKE2b, models.StrongHashMD4} {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strong hash: %q", name)
+}
+
+// Size returns the full length in bytes of the given strong digest, or 0 if it is unknown
+func Size(h models.StrongHash) int {
+	switch h {
+	case models.StrongHashSHA256:
+		return sha256.Size
+	case models.StrongHashBLAKE2b:
+		return blake2b.Size256
+	case models.StrongHashMD4:
+		return md4.Size
+	default:
+		return 0
+	}
+}
+
+// Validate checks that the strong hash is known and that length is a valid truncation of it
+func Validate(h models.StrongHash, length int) error {
+	size := Size(h)
+	if size == 0 {
+		return fmt.Errorf("unknown strong hash: %d", h)
+	}
+	if length < 1 || length > size {
+		return fmt.Errorf("invalid strong digest length %d for %s: must be between 1 and %d", length, h, size)
+	}
+	return nil
+}
+
+// Sum returns the strong digest of data truncated to length bytes. The hash must have been
+// checked with Validate.
+func Sum(h models.StrongHash, length int, data []byte) []byte {
+	var sum []byte
+	switch h {
+	case models.StrongHashBLAKE2b:
+		s := blake2b.Sum256(data)
+		sum = s[:]
+	case models.StrongHashMD4:
+		h := md4.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	default:
+		s := sha256.Sum256(data)
+		sum = s[:]
+	}
+	return sum[:length]
+}
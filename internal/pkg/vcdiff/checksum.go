@@ -0,0 +1,86 @@
+package vcdiff
+
+import (
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+)
+
+// ChecksumError is returned when a rebuilt target window does not match its Adler-32 checksum
+type ChecksumError struct {
+	Offset   int64  // offset of the window in the target
+	Expected uint32 // checksum recorded in the window
+	Actual   uint32 // checksum of the rebuilt window
+}
+
+// Error implements error
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("vcdiff: checksum mismatch in the target window at offset %d: rebuilt window has checksum %08x, window expects %08x", e.Offset, e.Actual, e.Expected)
+}
+
+// verifier checks the target written through it against the checksums of its windows
+type verifier struct {
+	w         io.Writer
+	checksums []WindowChecksum
+	pos       int64
+	hash      hash.Hash32
+}
+
+// NewVerifier returns a writer that writes the target to w and verifies every window with a
+// checksum, see DecodeChecksums, once it has been written. A write completing a window that
+// does not match its checksum returns a *ChecksumError, after writing the window to w.
+func NewVerifier(w io.Writer, checksums []WindowChecksum) io.Writer {
+	return &verifier{w: w, checksums: checksums, hash: adler32.New()}
+}
+
+// Write implements io.Writer
+func (v *verifier) Write(p []byte) (int, error) {
+	var written int
+	for {
+		if err := v.check(); err != nil {
+			return written, err
+		}
+		if len(p) == 0 {
+			return written, nil
+		}
+
+		// write up to the next window boundary
+		n := int64(len(p))
+		if len(v.checksums) > 0 {
+			c := v.checksums[0]
+			if v.pos < c.Offset {
+				n = minInt(n, c.Offset-v.pos)
+			} else {
+				n = minInt(n, c.Offset+c.Length-v.pos)
+				v.hash.Write(p[:n])
+			}
+		}
+
+		m, err := v.w.Write(p[:n])
+		written += m
+		v.pos += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+}
+
+// check verifies the windows that end at the current position
+func (v *verifier) check() error {
+	for len(v.checksums) > 0 {
+		c := v.checksums[0]
+		if v.pos < c.Offset || v.pos != c.Offset+c.Length {
+			return nil
+		}
+
+		actual := v.hash.Sum32()
+		v.hash.Reset()
+		v.checksums = v.checksums[1:]
+		if actual != c.Adler32 {
+			return &ChecksumError{Offset: c.Offset, Expected: c.Adler32, Actual: actual}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package vcdiff
+
+// Instruction types
+const (
+	instNoop = 0
+	instAdd  = 1
+	instRun  = 2
+	instCopy = 3
+)
+
+// Address modes
+const (
+	modeSelf = 0 // the address is encoded as is
+	modeHere = 1 // the address is encoded as its distance from the current position
+	modeNear = 2 // first of the nearSize modes relative to a recent address
+	modeSame = modeNear + nearSize
+	numModes = modeSame + sameSize
+)
+
+// instruction is half of a code table entry. A size of 0 means the size is read from the
+// instructions section.
+type instruction struct {
+	typ  byte
+	size byte
+	mode byte
+}
+
+// codeEntry is an entry of the code table, executing up to two instructions
+type codeEntry [2]instruction
+
+// defaultCodeTable is the default code table of RFC 3284 section 5.6
+var defaultCodeTable = buildDefaultCodeTable()
+
+// buildDefaultCodeTable builds the 256 entries of the default code table
+func buildDefaultCodeTable() [256]codeEntry {
+	var table [256]codeEntry
+	i := 0
+
+	// RUN with its size in the instructions section
+	table[i] = codeEntry{{typ: instRun}}
+	i++
+
+	// ADD of size 0 (size in the instructions section) and 1 to 17
+	for size := 0; size <= 17; size++ {
+		table[i] = codeEntry{{typ: instAdd, size: byte(size)}}
+		i++
+	}
+
+	// COPY of size 0 (size in the instructions section) and 4 to 18, for every mode
+	for mode := 0; mode < numModes; mode++ {
+		table[i] = codeEntry{{typ: instCopy, mode: byte(mode)}}
+		i++
+		for size := 4; size <= 18; size++ {
+			table[i] = codeEntry{{typ: instCopy, size: byte(size), mode: byte(mode)}}
+			i++
+		}
+	}
+
+	// ADD of size 1 to 4 followed by a COPY of size 4 to 6, for the self, here and near modes
+	for mode := 0; mode < modeSame; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				table[i] = codeEntry{{typ: instAdd, size: byte(addSize)}, {typ: instCopy, size: byte(copySize), mode: byte(mode)}}
+				i++
+			}
+		}
+	}
+
+	// ADD of size 1 to 4 followed by a COPY of size 4, for the same modes
+	for mode := modeSame; mode < numModes; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			table[i] = codeEntry{{typ: instAdd, size: byte(addSize)}, {typ: instCopy, size: 4, mode: byte(mode)}}
+			i++
+		}
+	}
+
+	// COPY of size 4 followed by an ADD of size 1, for every mode
+	for mode := 0; mode < numModes; mode++ {
+		table[i] = codeEntry{{typ: instCopy, size: 4, mode: byte(mode)}, {typ: instAdd, size: 1}}
+		i++
+	}
+
+	return table
+}
+
+// The encoder only emits single instructions, their indexes in the default code table are:
+const (
+	runIndex  = 0  // RUN, size in the instructions section
+	addIndex  = 1  // ADD, size in the instructions section; 1+size for sizes 1 to 17
+	copyIndex = 19 // COPY of mode 0, size in the instructions section
+	copyModes = 16 // entries per COPY mode; copyIndex+mode*copyModes+size-3 for sizes 4 to 18
+	maxAdd    = 17 // largest ADD size with its own entry
+	minCopy   = 4  // smallest COPY size with its own entry
+	maxCopy   = 18 // largest COPY size with its own entry
+)
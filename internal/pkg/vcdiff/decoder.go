@@ -0,0 +1,398 @@
+package vcdiff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// maxTargetWindow is the largest target window accepted by the decoder, it bounds the
+// memory used by a corrupt or malicious window
+const maxTargetWindow = 1 << 26
+
+// span records the instruction that produced the target bytes starting at start. COPY
+// instructions from the target are resolved through the spans into copies from the source
+// file and literals, which are the only instructions of models.Delta.
+type span struct {
+	start int64
+	op    models.Op
+}
+
+// WindowChecksum is the Adler-32 checksum xdelta3 records for a target window
+type WindowChecksum struct {
+	Offset  int64  // offset of the window in the target
+	Length  int64  // length of the window
+	Adler32 uint32 // checksum of the content of the window
+}
+
+// decoder holds the state of a VCDIFF file being decoded
+type decoder struct {
+	r         *bufio.Reader
+	delta     *models.Delta
+	spans     []span
+	total     int64 // length of the target decoded so far
+	checksums []WindowChecksum
+}
+
+// Decode reads a VCDIFF file. Copies from the target are resolved into copies from the
+// source file and literals. The target length is computed from the instructions, the
+// checksum is left empty. The checksums of the windows are dropped, see DecodeChecksums.
+func Decode(r io.Reader) (*models.Delta, error) {
+	delta, _, err := DecodeChecksums(r)
+	return delta, err
+}
+
+// DecodeChecksums reads a VCDIFF file like Decode, and also returns the checksums of the
+// windows that carry one, in target order. They can only be verified against the rebuilt
+// target, see NewVerifier.
+func DecodeChecksums(r io.Reader) (*models.Delta, []WindowChecksum, error) {
+	d := &decoder{
+		r:     bufio.NewReader(r),
+		delta: &models.Delta{Ops: make([]models.Op, 0)},
+	}
+
+	if err := d.readHeader(); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		indicator, err := d.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("vcdiff: error reading window: %w", err)
+		}
+		if err := d.readWindow(indicator); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	d.delta.End()
+	d.delta.TargetLength = d.total
+	return d.delta, d.checksums, nil
+}
+
+// readHeader reads the file header
+func (d *decoder) readHeader() error {
+	var header [5]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return fmt.Errorf("vcdiff: error reading header: %w", err)
+	}
+	if !IsVCDIFF(header[:]) {
+		return ErrBadMagic
+	}
+	if header[3] != Magic[3] {
+		return fmt.Errorf("vcdiff: unsupported version %#x", header[3])
+	}
+
+	indicator := header[4]
+	if indicator&hdrDecompress != 0 {
+		return fmt.Errorf("vcdiff: secondary compression is not supported")
+	}
+	if indicator&hdrCodeTable != 0 {
+		return fmt.Errorf("vcdiff: application defined code tables are not supported")
+	}
+	if indicator&hdrAppHeader != 0 {
+		n, err := readVarint(d.r)
+		if err != nil {
+			return fmt.Errorf("vcdiff: error reading application header: %w", unexpectedEOF(err))
+		}
+		if _, err := readSection(d.r, n); err != nil {
+			return fmt.Errorf("vcdiff: error reading application header: %w", err)
+		}
+	}
+	return nil
+}
+
+// readWindow reads and executes a window
+func (d *decoder) readWindow(indicator byte) error {
+	if indicator&(winSource|winTarget) == winSource|winTarget {
+		return fmt.Errorf("vcdiff: window has both a source and a target segment")
+	}
+
+	var segSize, segPos int64
+	if indicator&(winSource|winTarget) != 0 {
+		var err error
+		if segSize, err = readVarint(d.r); err != nil {
+			return fmt.Errorf("vcdiff: error reading source segment: %w", unexpectedEOF(err))
+		}
+		if segPos, err = readVarint(d.r); err != nil {
+			return fmt.Errorf("vcdiff: error reading source segment: %w", unexpectedEOF(err))
+		}
+		if indicator&winTarget != 0 && segPos+segSize > d.total {
+			return fmt.Errorf("vcdiff: source segment [%d, %d) is past the decoded target", segPos, segPos+segSize)
+		}
+	}
+
+	length, err := readVarint(d.r)
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading delta encoding length: %w", unexpectedEOF(err))
+	}
+	enc, err := readSection(d.r, length)
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading delta encoding: %w", err)
+	}
+
+	br := &byteReader{b: enc}
+	targetLen, err := readVarint(br)
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading target window length: %w", err)
+	}
+	deltaIndicator, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading delta indicator: %w", err)
+	}
+	if targetLen > maxTargetWindow {
+		return fmt.Errorf("vcdiff: target window of %d bytes exceeds the limit of %d", targetLen, maxTargetWindow)
+	}
+	if deltaIndicator != 0 {
+		return fmt.Errorf("vcdiff: compressed sections are not supported")
+	}
+
+	var lengths [3]int64
+	for i := range lengths {
+		if lengths[i], err = readVarint(br); err != nil {
+			return fmt.Errorf("vcdiff: error reading section lengths: %w", err)
+		}
+	}
+	if indicator&winAdler32 != 0 {
+		b, err := br.next(4)
+		if err != nil {
+			return fmt.Errorf("vcdiff: error reading window checksum: %w", err)
+		}
+		d.checksums = append(d.checksums, WindowChecksum{Offset: d.total, Length: targetLen, Adler32: binary.BigEndian.Uint32(b)})
+	}
+
+	var sections [3]*byteReader
+	for i, n := range lengths {
+		b, err := br.next(n)
+		if err != nil {
+			return fmt.Errorf("vcdiff: error reading window sections: %w", err)
+		}
+		sections[i] = &byteReader{b: b}
+	}
+	if br.remaining() != 0 {
+		return fmt.Errorf("vcdiff: %d unexpected bytes after the window sections", br.remaining())
+	}
+
+	w := &window{
+		decoder:   d,
+		indicator: indicator,
+		segSize:   segSize,
+		segPos:    segPos,
+		start:     d.total,
+		end:       d.total + targetLen,
+		data:      sections[0],
+		inst:      sections[1],
+		addrs:     sections[2],
+	}
+	if err := w.execute(); err != nil {
+		return err
+	}
+
+	if produced := d.total - w.start; produced != targetLen {
+		return fmt.Errorf("vcdiff: window produced %d bytes, expected %d", produced, targetLen)
+	}
+	return nil
+}
+
+// window holds the state of a window being executed
+type window struct {
+	*decoder
+	indicator         byte
+	segSize, segPos   int64
+	start, end        int64 // target offsets of the window
+	data, inst, addrs *byteReader
+	cache             addressCache
+}
+
+// execute runs the instructions of the window
+func (w *window) execute() error {
+	for w.inst.remaining() > 0 {
+		index, _ := w.inst.ReadByte()
+		for _, in := range defaultCodeTable[index] {
+			if in.typ == instNoop {
+				continue
+			}
+
+			size := int64(in.size)
+			if size == 0 {
+				var err error
+				if size, err = readVarint(w.inst); err != nil {
+					return fmt.Errorf("vcdiff: error reading instruction size: %w", err)
+				}
+			}
+
+			if size > w.end-w.total {
+				return fmt.Errorf("vcdiff: instruction of %d bytes overflows the target window", size)
+			}
+
+			var err error
+			switch in.typ {
+			case instAdd:
+				err = w.add(size)
+			case instRun:
+				err = w.run(size)
+			case instCopy:
+				err = w.copy(size, in.mode)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.data.remaining() != 0 || w.addrs.remaining() != 0 {
+		return fmt.Errorf("vcdiff: unused data or addresses at the end of the window")
+	}
+	return nil
+}
+
+// add executes an ADD instruction
+func (w *window) add(size int64) error {
+	b, err := w.data.next(size)
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading ADD data: %w", err)
+	}
+	w.literal(b)
+	return nil
+}
+
+// run executes a RUN instruction
+func (w *window) run(size int64) error {
+	b, err := w.data.next(1)
+	if err != nil {
+		return fmt.Errorf("vcdiff: error reading RUN byte: %w", err)
+	}
+	w.literal(bytes.Repeat(b, int(size)))
+	return nil
+}
+
+// copy executes a COPY instruction
+func (w *window) copy(size int64, mode byte) error {
+	here := w.segSize + w.total - w.start
+
+	addr, err := w.address(mode, here)
+	if err != nil {
+		return err
+	}
+	if addr < 0 || addr >= here {
+		return fmt.Errorf("vcdiff: COPY address %d out of range [0, %d)", addr, here)
+	}
+
+	for size > 0 {
+		if addr < w.segSize {
+			// copy from the source segment
+			n := minInt(size, w.segSize-addr)
+			if w.indicator&winSource != 0 {
+				w.emit(models.Op{Kind: models.OpCopy, Offset: w.segPos + addr, Length: n})
+			} else {
+				w.resolve(w.segPos+addr, n)
+			}
+			addr, size = addr+n, size-n
+			continue
+		}
+
+		// copy from the target window. The copy may overlap the bytes it produces, which
+		// repeats the period between the address and the current position: copying the
+		// bytes available so far doubles them at every step.
+		from := w.start + addr - w.segSize
+		n := minInt(size, w.total-from)
+		w.resolve(from, n)
+		size -= n
+	}
+	return nil
+}
+
+// address decodes the address of a COPY instruction
+func (w *window) address(mode byte, here int64) (int64, error) {
+	var addr int64
+	switch {
+	case mode < modeSame:
+		v, err := readVarint(w.addrs)
+		if err != nil {
+			return 0, fmt.Errorf("vcdiff: error reading COPY address: %w", err)
+		}
+		switch {
+		case mode == modeSelf:
+			addr = v
+		case mode == modeHere:
+			addr = here - v
+		default:
+			addr = w.cache.near[mode-modeNear] + v
+		}
+	default:
+		b, err := w.addrs.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("vcdiff: error reading COPY address: %w", err)
+		}
+		addr = w.cache.same[int(mode-modeSame)*256+int(b)]
+	}
+
+	w.cache.update(addr)
+	return addr, nil
+}
+
+// literal appends literal bytes to the target
+func (d *decoder) literal(b []byte) {
+	if len(b) > 0 {
+		d.emit(models.Op{Kind: models.OpLiteral, Length: int64(len(b)), Data: b})
+	}
+}
+
+// emit appends an instruction to the delta and records the target bytes it produces
+func (d *decoder) emit(op models.Op) {
+	d.spans = append(d.spans, span{start: d.total, op: op})
+	d.total += op.Length
+
+	if op.Kind == models.OpCopy {
+		d.delta.AddCopy(op.Offset, op.Length)
+	} else {
+		d.delta.AddLiteral(op.Data)
+	}
+}
+
+// resolve appends the instructions that produced the target bytes [from, from+n). The
+// range must have been decoded already.
+func (d *decoder) resolve(from, n int64) {
+	// the spans produced before the call, new spans are appended while resolving
+	spans := d.spans
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].start+spans[i].op.Length > from
+	})
+
+	for ; n > 0; i++ {
+		s := spans[i]
+		skip := from - s.start
+		length := minInt(n, s.op.Length-skip)
+
+		if s.op.Kind == models.OpCopy {
+			d.emit(models.Op{Kind: models.OpCopy, Offset: s.op.Offset + skip, Length: length})
+		} else {
+			d.literal(s.op.Data[skip : skip+length])
+		}
+		from, n = from+length, n-length
+	}
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, a window must be complete
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// minInt returns the smaller of a and b
+func minInt(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,245 @@
+package vcdiff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// MaxWindowSize is the largest target window the Writer produces
+const MaxWindowSize = 1 << 22
+
+// minRun is the shortest run of identical literal bytes encoded as a RUN instead of an ADD
+const minRun = 8
+
+// Writer writes delta instructions as VCDIFF windows. Instructions are buffered until a
+// target window is full, Flush must be called once all instructions have been written.
+type Writer struct {
+	w           *bufio.Writer
+	wroteHeader bool
+
+	ops       []models.Op // instructions of the current window
+	targetLen int64       // target length of the current window
+}
+
+// NewWriter returns a Writer writing to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteOp writes a single instruction. END instructions only flush the current window,
+// the end of a VCDIFF file is the end of its last window.
+func (vw *Writer) WriteOp(op models.Op) error {
+	switch op.Kind {
+	case models.OpCopy, models.OpLiteral:
+	case models.OpEnd:
+		return vw.writeWindow()
+	default:
+		return fmt.Errorf("vcdiff: unknown delta instruction: %d", op.Kind)
+	}
+
+	// split the instruction over as many windows as needed
+	for op.Length > 0 {
+		n := op.Length
+		if room := MaxWindowSize - vw.targetLen; n > room {
+			n = room
+		}
+
+		part := models.Op{Kind: op.Kind, Offset: op.Offset, Length: n}
+		if op.Kind == models.OpLiteral {
+			// the data is buffered until the window is written, the caller may reuse op.Data
+			part.Data = append([]byte(nil), op.Data[:n]...)
+			op.Data = op.Data[n:]
+		} else {
+			op.Offset += n
+		}
+		op.Length -= n
+
+		vw.ops = append(vw.ops, part)
+		vw.targetLen += n
+
+		if vw.targetLen == MaxWindowSize {
+			if err := vw.writeWindow(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered window and any buffered data to the underlying writer
+func (vw *Writer) Flush() error {
+	if err := vw.writeWindow(); err != nil {
+		return err
+	}
+	if err := vw.writeHeader(); err != nil {
+		return err
+	}
+	return vw.w.Flush()
+}
+
+// writeHeader writes the file header once, before the first window
+func (vw *Writer) writeHeader() error {
+	if vw.wroteHeader {
+		return nil
+	}
+	vw.wroteHeader = true
+
+	_, err := vw.w.Write(append(Magic[:], 0))
+	return err
+}
+
+// writeWindow encodes the buffered instructions as one window
+func (vw *Writer) writeWindow() error {
+	if len(vw.ops) == 0 {
+		return nil
+	}
+	if err := vw.writeHeader(); err != nil {
+		return err
+	}
+
+	// the source segment spans every COPY of the window
+	segPos, segEnd := int64(-1), int64(0)
+	for _, op := range vw.ops {
+		if op.Kind != models.OpCopy {
+			continue
+		}
+		if segPos < 0 || op.Offset < segPos {
+			segPos = op.Offset
+		}
+		if end := op.Offset + op.Length; end > segEnd {
+			segEnd = end
+		}
+	}
+
+	var segSize int64
+	if segPos >= 0 {
+		segSize = segEnd - segPos
+	}
+
+	var (
+		data, inst, addrs []byte
+		cache             addressCache
+		here              = segSize
+	)
+
+	for _, op := range vw.ops {
+		switch op.Kind {
+		case models.OpCopy:
+			inst, addrs = encodeCopy(inst, addrs, &cache, op.Offset-segPos, op.Length, here)
+		case models.OpLiteral:
+			data, inst = encodeLiteral(data, inst, op.Data)
+		}
+		here += op.Length
+	}
+
+	// delta encoding: target window length, delta indicator, section lengths and sections
+	var enc []byte
+	enc = appendVarint(enc, vw.targetLen)
+	enc = append(enc, 0)
+	enc = appendVarint(enc, int64(len(data)))
+	enc = appendVarint(enc, int64(len(inst)))
+	enc = appendVarint(enc, int64(len(addrs)))
+
+	var header []byte
+	if segPos >= 0 {
+		header = append(header, winSource)
+		header = appendVarint(header, segSize)
+		header = appendVarint(header, segPos)
+	} else {
+		header = append(header, 0)
+	}
+	header = appendVarint(header, int64(len(enc)+len(data)+len(inst)+len(addrs)))
+
+	for _, b := range [][]byte{header, enc, data, inst, addrs} {
+		if _, err := vw.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	vw.ops = vw.ops[:0]
+	vw.targetLen = 0
+	return nil
+}
+
+// encodeLiteral encodes literal data as ADD instructions, and RUN instructions for long runs
+// of identical bytes
+func encodeLiteral(data, inst []byte, literal []byte) ([]byte, []byte) {
+	start := 0
+	for i := 0; i < len(literal); {
+		j := i + 1
+		for j < len(literal) && literal[j] == literal[i] {
+			j++
+		}
+
+		if j-i >= minRun {
+			data, inst = encodeAdd(data, inst, literal[start:i])
+			data = append(data, literal[i])
+			inst = append(inst, runIndex)
+			inst = appendVarint(inst, int64(j-i))
+			start = j
+		}
+		i = j
+	}
+	return encodeAdd(data, inst, literal[start:])
+}
+
+// encodeAdd encodes an ADD instruction
+func encodeAdd(data, inst []byte, literal []byte) ([]byte, []byte) {
+	if len(literal) == 0 {
+		return data, inst
+	}
+	data = append(data, literal...)
+	if len(literal) <= maxAdd {
+		return data, append(inst, byte(addIndex+len(literal)))
+	}
+	inst = append(inst, addIndex)
+	return data, appendVarint(inst, int64(len(literal)))
+}
+
+// encodeCopy encodes a COPY instruction with the address mode giving the shortest encoding
+func encodeCopy(inst, addrs []byte, cache *addressCache, addr, size, here int64) ([]byte, []byte) {
+	mode, encoded := byte(modeSelf), addr
+	best := varintLen(addr)
+
+	if n := varintLen(here - addr); n < best {
+		mode, encoded, best = modeHere, here-addr, n
+	}
+	for i, near := range cache.near {
+		if addr < near {
+			continue
+		}
+		if n := varintLen(addr - near); n < best {
+			mode, encoded, best = byte(modeNear+i), addr-near, n
+		}
+	}
+
+	same := addr % (sameSize * 256)
+	if cache.same[same] == addr && best > 1 {
+		mode, encoded = byte(modeSame+same/256), same%256
+		addrs = append(addrs, byte(encoded))
+	} else {
+		addrs = appendVarint(addrs, encoded)
+	}
+	cache.update(addr)
+
+	index := copyIndex + int(mode)*copyModes
+	if size >= minCopy && size <= maxCopy {
+		return append(inst, byte(index+int(size)-3)), addrs
+	}
+	inst = append(inst, byte(index))
+	return appendVarint(inst, size), addrs
+}
+
+// Encode writes the delta as a VCDIFF file
+func Encode(w io.Writer, delta *models.Delta) error {
+	vw := NewWriter(w)
+	for _, op := range delta.Ops {
+		if err := vw.WriteOp(op); err != nil {
+			return err
+		}
+	}
+	return vw.Flush()
+}
@@ -0,0 +1,143 @@
+// Package vcdiff implements the VCDIFF generic differencing and compression data format
+// described in RFC 3284, so that deltas can be exchanged with tools such as xdelta3 and
+// open-vcdiff. Only the default code table is supported, without secondary compression.
+package vcdiff
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic is the first bytes of a VCDIFF file: "VCD" with the high bits set, and version 0
+var Magic = [4]byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Header indicator bits
+const (
+	hdrDecompress = 0x01 // a secondary compressor is used
+	hdrCodeTable  = 0x02 // an application defined code table is used
+	hdrAppHeader  = 0x04 // application data follows the header
+)
+
+// Window indicator bits
+const (
+	winSource  = 0x01 // the source segment is taken from the source (basis) file
+	winTarget  = 0x02 // the source segment is taken from the target decoded so far
+	winAdler32 = 0x04 // xdelta3 extension (VCD_ADLER32), see below
+)
+
+// xdelta3 sets winAdler32 on windows followed by the Adler-32 checksum of their target window,
+// 4 bytes big-endian right after the section lengths. open-vcdiff sets the same bit with the
+// checksum as a varint, but only in its own 'S' version of the format, which is not supported.
+
+// Address cache sizes of the default code table
+const (
+	nearSize = 4
+	sameSize = 3
+)
+
+// ErrBadMagic is returned when the input does not start with the VCDIFF magic bytes
+var ErrBadMagic = errors.New("vcdiff: bad magic bytes")
+
+// IsVCDIFF reports whether the header bytes start a VCDIFF file
+func IsVCDIFF(header []byte) bool {
+	return len(header) >= 3 && header[0] == Magic[0] && header[1] == Magic[1] && header[2] == Magic[2]
+}
+
+// appendVarint appends v as a VCDIFF variable length integer: base 128, most significant
+// digit first, with the high bit set on every byte but the last one.
+func appendVarint(b []byte, v int64) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+// varintLen returns the number of bytes appendVarint uses for v
+func varintLen(v int64) int {
+	n := 1
+	for v >>= 7; v > 0; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// readVarint reads a VCDIFF variable length integer
+func readVarint(r io.ByteReader) (int64, error) {
+	var v int64
+	for i := 0; i < 9; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | int64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("vcdiff: integer overflow")
+}
+
+// byteReader is an io.ByteReader over a section of a window
+type byteReader struct {
+	b   []byte
+	pos int
+}
+
+// ReadByte implements io.ByteReader
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// next returns the next n bytes of the section
+func (r *byteReader) next(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.b)-r.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+// remaining returns the number of unread bytes of the section
+func (r *byteReader) remaining() int {
+	return len(r.b) - r.pos
+}
+
+// readSection reads n bytes from r. The buffer grows with the data actually read, so a
+// corrupt length can not exhaust memory.
+func readSection(r *bufio.Reader, n int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// addressCache is the near and same address cache of RFC 3284 section 5.1. The encoder
+// and the decoder update it identically after every COPY instruction.
+type addressCache struct {
+	near     [nearSize]int64
+	nextSlot int
+	same     [sameSize * 256]int64
+}
+
+// update records a COPY address
+func (c *addressCache) update(addr int64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % nearSize
+	c.same[addr%(sameSize*256)] = addr
+}
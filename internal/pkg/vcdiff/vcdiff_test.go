@@ -0,0 +1,443 @@
+package vcdiff
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/librsync"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// rebuild applies the delta to basis
+func rebuild(t *testing.T, basis []byte, delta *models.Delta) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	for _, op := range delta.Ops {
+		switch op.Kind {
+		case models.OpCopy:
+			if op.Offset+op.Length > int64(len(basis)) {
+				t.Fatalf("copy of %d bytes at offset %d past the end of the basis", op.Length, op.Offset)
+			}
+			out.Write(basis[op.Offset : op.Offset+op.Length])
+		case models.OpLiteral:
+			out.Write(op.Data)
+		case models.OpEnd:
+			return out.Bytes()
+		}
+	}
+	t.Fatalf("missing END instruction")
+	return nil
+}
+
+// codeIndex returns the index of the entry in the default code table
+func codeIndex(t *testing.T, entry codeEntry) byte {
+	t.Helper()
+
+	for i, e := range defaultCodeTable {
+		if e == entry {
+			return byte(i)
+		}
+	}
+	t.Fatalf("entry %+v is not in the default code table", entry)
+	return 0
+}
+
+// buildWindow returns a window without a checksum
+func buildWindow(indicator byte, segSize, segPos, targetLen int64, data, inst, addrs []byte) []byte {
+	return assembleWindow(indicator, segSize, segPos, targetLen, nil, data, inst, addrs)
+}
+
+// buildAdler32Window returns a window with an Adler-32 checksum, laid out like xdelta3 does
+func buildAdler32Window(indicator byte, segSize, segPos, targetLen int64, checksum uint32, data, inst, addrs []byte) []byte {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, checksum)
+	return assembleWindow(indicator|winAdler32, segSize, segPos, targetLen, sum, data, inst, addrs)
+}
+
+// assembleWindow returns a window, checksum is written after the section lengths
+func assembleWindow(indicator byte, segSize, segPos, targetLen int64, checksum, data, inst, addrs []byte) []byte {
+	var enc []byte
+	enc = appendVarint(enc, targetLen)
+	enc = append(enc, 0)
+	enc = appendVarint(enc, int64(len(data)))
+	enc = appendVarint(enc, int64(len(inst)))
+	enc = appendVarint(enc, int64(len(addrs)))
+	enc = append(enc, checksum...)
+	enc = append(enc, data...)
+	enc = append(enc, inst...)
+	enc = append(enc, addrs...)
+
+	b := []byte{indicator}
+	if indicator&(winSource|winTarget) != 0 {
+		b = appendVarint(b, segSize)
+		b = appendVarint(b, segPos)
+	}
+	b = appendVarint(b, int64(len(enc)))
+	return append(b, enc...)
+}
+
+func TestVarint(t *testing.T) {
+	// example of RFC 3284 section 2
+	if got := appendVarint(nil, 123456789); !bytes.Equal(got, []byte{0xba, 0xef, 0x9a, 0x15}) {
+		t.Errorf("unexpected encoding: got %x", got)
+	}
+
+	for _, v := range []int64{0, 1, 127, 128, 16383, 16384, 1 << 40, 1<<63 - 1} {
+		b := appendVarint(nil, v)
+		if len(b) != varintLen(v) {
+			t.Errorf("unexpected length for %d: got %d, want %d", v, varintLen(v), len(b))
+		}
+		got, err := readVarint(&byteReader{b: b})
+		if err != nil || got != v {
+			t.Errorf("unexpected decoding of %d: got %d, %v", v, got, err)
+		}
+	}
+}
+
+func TestCodeTable(t *testing.T) {
+	if n := len(defaultCodeTable); n != 256 {
+		t.Fatalf("unexpected code table size: %d", n)
+	}
+
+	// a few entries listed in RFC 3284 section 5.6
+	tests := []struct {
+		index int
+		entry codeEntry
+	}{
+		{0, codeEntry{{typ: instRun}}},
+		{1, codeEntry{{typ: instAdd}}},
+		{18, codeEntry{{typ: instAdd, size: 17}}},
+		{19, codeEntry{{typ: instCopy, mode: modeSelf}}},
+		{34, codeEntry{{typ: instCopy, size: 18, mode: modeSelf}}},
+		{162, codeEntry{{typ: instCopy, size: 18, mode: 8}}},
+		{163, codeEntry{{typ: instAdd, size: 1}, {typ: instCopy, size: 4, mode: modeSelf}}},
+		{234, codeEntry{{typ: instAdd, size: 4}, {typ: instCopy, size: 6, mode: 5}}},
+		{235, codeEntry{{typ: instAdd, size: 1}, {typ: instCopy, size: 4, mode: 6}}},
+		{247, codeEntry{{typ: instCopy, size: 4, mode: modeSelf}, {typ: instAdd, size: 1}}},
+		{255, codeEntry{{typ: instCopy, size: 4, mode: 8}, {typ: instAdd, size: 1}}},
+	}
+	for _, test := range tests {
+		if got := defaultCodeTable[test.index]; got != test.entry {
+			t.Errorf("unexpected entry %d: got %+v, want %+v", test.index, got, test.entry)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 1<<20)
+	rnd.Read(basis)
+
+	noise := make([]byte, MaxWindowSize+100)
+	rnd.Read(noise)
+
+	tests := []struct {
+		name string
+		ops  []models.Op
+	}{
+		{"empty", nil},
+		{"copy", []models.Op{
+			{Kind: models.OpCopy, Offset: 0, Length: int64(len(basis))},
+		}},
+		{"reordered copies", []models.Op{
+			{Kind: models.OpCopy, Offset: 5000, Length: 3},
+			{Kind: models.OpCopy, Offset: 100, Length: 18},
+			{Kind: models.OpCopy, Offset: 100, Length: 4},
+			{Kind: models.OpCopy, Offset: 5000, Length: 3},
+			{Kind: models.OpCopy, Offset: 1 << 19, Length: 1 << 19},
+			{Kind: models.OpCopy, Offset: 120, Length: 19},
+		}},
+		{"literals and runs", []models.Op{
+			{Kind: models.OpLiteral, Length: 1, Data: []byte("a")},
+			{Kind: models.OpCopy, Offset: 7, Length: 10},
+			{Kind: models.OpLiteral, Length: 27, Data: []byte("bbbbbbbbbbcdefgggggggggggzz")},
+			{Kind: models.OpLiteral, Length: 1000, Data: bytes.Repeat([]byte{0}, 1000)},
+		}},
+		{"several windows", []models.Op{
+			{Kind: models.OpCopy, Offset: 10, Length: 100},
+			{Kind: models.OpLiteral, Length: int64(len(noise)), Data: noise},
+			{Kind: models.OpCopy, Offset: 0, Length: int64(len(basis))},
+			{Kind: models.OpCopy, Offset: 0, Length: int64(len(basis))},
+			{Kind: models.OpCopy, Offset: 0, Length: int64(len(basis))},
+			{Kind: models.OpCopy, Offset: 0, Length: int64(len(basis))},
+		}},
+	}
+
+	for _, test := range tests {
+		delta := &models.Delta{Ops: test.ops}
+		for _, op := range test.ops {
+			delta.TargetLength += op.Length
+		}
+		delta.End()
+		want := rebuild(t, basis, delta)
+
+		var encoded bytes.Buffer
+		if err := Encode(&encoded, delta); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !IsVCDIFF(encoded.Bytes()) {
+			t.Errorf("%s: encoded delta does not start with the VCDIFF magic", test.name)
+		}
+
+		decoded, err := Decode(&encoded)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if decoded.TargetLength != int64(len(want)) {
+			t.Errorf("%s: unexpected target length: got %d, want %d", test.name, decoded.TargetLength, len(want))
+		}
+		if got := rebuild(t, basis, decoded); !bytes.Equal(got, want) {
+			t.Errorf("%s: decoded delta does not rebuild the target", test.name)
+		}
+	}
+}
+
+func TestRoundTripLibrsync(t *testing.T) {
+	ctx := context.Background()
+
+	basis, err := ioutil.ReadFile("../librsync/testdata/basis.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := ioutil.ReadFile("../librsync/testdata/new.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sigFile, err := os.Open("../librsync/testdata/basis-rk-blake2.sig")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sigFile.Close()
+
+	sig, err := librsync.DecodeSignature(sigFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delta, err := diff.Compare(ctx, sig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var encoded bytes.Buffer
+	if err := Encode(&encoded, delta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded, err := Decode(&encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := rebuild(t, basis, decoded); !bytes.Equal(got, updated) {
+		t.Errorf("decoded delta does not rebuild new.txt")
+	}
+}
+
+func TestDecodeInstructions(t *testing.T) {
+	basis := []byte("abcdefgh")
+
+	// header with an application header that must be skipped
+	file := append(Magic[:], hdrAppHeader, 3, 'a', 'p', 'p')
+
+	// first window, over the whole basis:
+	//   ADD "X" + COPY 4 from address 0           -> "Xabcd"
+	//   COPY 6 from address 9, in HERE mode        -> "abcdab" overlapping its own output
+	//   COPY 4 from address 9, in NEAR mode        -> "abcd"
+	//   COPY 4 from address 9, in SAME mode        -> "abcd"
+	//   RUN 3 of "z"                               -> "zzz"
+	data := []byte("Xz")
+	inst := []byte{
+		codeIndex(t, codeEntry{{typ: instAdd, size: 1}, {typ: instCopy, size: 4, mode: modeSelf}}),
+		codeIndex(t, codeEntry{{typ: instCopy, size: 6, mode: modeHere}}),
+		codeIndex(t, codeEntry{{typ: instCopy, size: 4, mode: modeNear + 1}}),
+		codeIndex(t, codeEntry{{typ: instCopy, size: 4, mode: modeSame}}),
+		runIndex, 3,
+	}
+	addrs := []byte{0, 13 - 9, 0, 9}
+	file = append(file, buildWindow(winSource, 8, 0, 22, data, inst, addrs)...)
+
+	// second window, over "abcd" of the decoded target, with a checksum:
+	//   COPY 4 from address 0  -> "abcd"
+	//   ADD "!!"               -> "!!"
+	inst = []byte{codeIndex(t, codeEntry{{typ: instCopy, size: 4, mode: modeSelf}}), addIndex, 2}
+	file = append(file, buildAdler32Window(winTarget, 4, 1, 6, 0x01020304, []byte("!!"), inst, []byte{0})...)
+
+	delta, err := Decode(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "Xabcdabcdababcdabcdzzzabcd!!"
+	if got := rebuild(t, basis, delta); string(got) != want {
+		t.Errorf("unexpected target: got %q, want %q", got, want)
+	}
+	if delta.TargetLength != int64(len(want)) {
+		t.Errorf("unexpected target length: got %d, want %d", delta.TargetLength, len(want))
+	}
+	if last := delta.Ops[len(delta.Ops)-1]; last.Kind != models.OpEnd {
+		t.Errorf("unexpected last instruction: got %s, want %s", last.Kind, models.OpEnd)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	header := func(b ...byte) []byte {
+		return append(append(Magic[:], 0), b...)
+	}
+	copyIndex4 := byte(copyIndex + 1)
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"secondary compression", append(Magic[:], hdrDecompress)},
+		{"code table", append(Magic[:], hdrCodeTable)},
+		{"open-vcdiff format", []byte{Magic[0], Magic[1], Magic[2], 'S', 0}},
+		{"truncated window", header(buildWindow(0, 0, 0, 3, []byte("abc"), []byte{addIndex + 3}, nil)[:6]...)},
+		{"short window", header(buildWindow(0, 0, 0, 4, []byte("abc"), []byte{addIndex + 3}, nil)...)},
+		{"long window", header(buildWindow(0, 0, 0, 2, []byte("abc"), []byte{addIndex + 3}, nil)...)},
+		{"address out of range", header(buildWindow(winSource, 8, 0, 4, nil, []byte{copyIndex4}, []byte{8})...)},
+		{"unused data", header(buildWindow(0, 0, 0, 1, []byte("ab"), []byte{addIndex + 1}, nil)...)},
+		{"target segment past the target", header(buildWindow(winTarget, 8, 0, 4, nil, []byte{copyIndex4}, []byte{0})...)},
+	}
+
+	for _, test := range tests {
+		if _, err := Decode(bytes.NewReader(test.file)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	if _, err := Decode(bytes.NewReader([]byte{0x72, 0x73, 0x02, 0x36, 0})); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("unexpected error for a librsync delta: got %v, want %v", err, ErrBadMagic)
+	}
+	if _, err := Decode(bytes.NewReader(Magic[:3])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error for a truncated header: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// adler32File returns a VCDIFF file laid out like xdelta3 writes them, with an application
+// header and Adler-32 checksums, rebuilding "hello world, xdelta3!!!" from basis. The checksum
+// of the first window is the given one.
+func adler32File(checksum uint32) []byte {
+	file := append(Magic[:], hdrAppHeader)
+	app := []byte("target//basis/")
+	file = append(appendVarint(file, int64(len(app))), app...)
+
+	// COPY 13 from address 0 + ADD "xdelta3" -> "hello world, xdelta3"
+	inst := []byte{
+		copyIndex, 13,
+		addIndex + 7,
+	}
+	file = append(file, buildAdler32Window(winSource, 13, 0, 20, checksum, []byte("xdelta3"), inst, []byte{0})...)
+
+	// RUN 3 of "!", without a checksum -> "!!!"
+	return append(file, buildWindow(0, 0, 0, 3, []byte("!"), []byte{runIndex, 3}, nil)...)
+}
+
+func TestWindowChecksums(t *testing.T) {
+	basis := []byte("hello world, hello vcdiff")
+	want := []byte("hello world, xdelta3!!!")
+	checksum := adler32.Checksum(want[:20])
+
+	delta, checksums, err := DecodeChecksums(bytes.NewReader(adler32File(checksum)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(checksums) != 1 || checksums[0] != (WindowChecksum{Offset: 0, Length: 20, Adler32: checksum}) {
+		t.Fatalf("unexpected checksums: %+v", checksums)
+	}
+
+	// the target is written in pieces that do not match the windows
+	target := rebuild(t, basis, delta)
+	var out bytes.Buffer
+	w := NewVerifier(&out, checksums)
+	for _, n := range []int{5, 11, 0, 7} {
+		if _, err := w.Write(target[:n]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		target = target[n:]
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("unexpected target: got %q, want %q", out.Bytes(), want)
+	}
+
+	// a window that does not match its checksum
+	delta, checksums, err = DecodeChecksums(bytes.NewReader(adler32File(checksum + 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = NewVerifier(ioutil.Discard, checksums).Write(rebuild(t, basis, delta))
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || checksumErr.Offset != 0 || checksumErr.Actual != checksum {
+		t.Errorf("unexpected error: got %v, want a *ChecksumError", err)
+	}
+}
+
+func TestXdelta3(t *testing.T) {
+	xdelta3, err := exec.LookPath("xdelta3")
+	if err != nil {
+		t.Skip("xdelta3 is not installed")
+	}
+
+	rnd := rand.New(rand.NewSource(3))
+	basis := make([]byte, 1<<20)
+	rnd.Read(basis)
+	target := append(append(append([]byte(nil), basis[1000:400000]...), "inserted"...), basis[500000:]...)
+
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return path
+	}
+	basisPath, targetPath := write("basis", basis), write("target", target)
+
+	// xdelta3 to this package: without secondary compression, with window checksums
+	deltaPath := filepath.Join(dir, "delta")
+	if out, err := exec.Command(xdelta3, "-e", "-f", "-S", "none", "-s", basisPath, targetPath, deltaPath).CombinedOutput(); err != nil {
+		t.Fatalf("xdelta3 failed: %v: %s", err, out)
+	}
+	f, err := os.Open(deltaPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	delta, checksums, err := DecodeChecksums(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(checksums) == 0 {
+		t.Errorf("xdelta3 wrote no window checksums")
+	}
+	var out bytes.Buffer
+	if _, err := NewVerifier(&out, checksums).Write(rebuild(t, basis, delta)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Errorf("the xdelta3 delta does not rebuild the target")
+	}
+
+	// this package to xdelta3
+	var encoded bytes.Buffer
+	if err := Encode(&encoded, delta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	encodedPath, decodedPath := write("encoded", encoded.Bytes()), filepath.Join(dir, "decoded")
+	if out, err := exec.Command(xdelta3, "-d", "-f", "-s", basisPath, encodedPath, decodedPath).CombinedOutput(); err != nil {
+		t.Fatalf("xdelta3 failed: %v: %s", err, out)
+	}
+	if decoded, err := os.ReadFile(decodedPath); err != nil || !bytes.Equal(decoded, target) {
+		t.Errorf("xdelta3 did not rebuild the target: %v", err)
+	}
+}
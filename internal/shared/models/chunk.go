@@ -5,10 +5,11 @@ import (
 	"fmt"
 )
 
-// Chunk represents a chunk of data
+// Chunk represents a chunk of data. It only holds the digests of the data, never the data itself,
+// so a signature stays small no matter how large the file is.
 type Chunk struct {
-	Data   []byte // the data of the chunk
-	Hash   uint64 // the rolling hash value of the data
+	Weak   uint32 // the weak rolling checksum of the data
+	Strong []byte // the strong digest of the data, used to confirm weak matches
 	Offset int64  // the starting position of the chunk in the file
 	Length int64  // the length of the chunk
 }
@@ -21,19 +22,25 @@ func (c *Chunk) ValidateChunk(other *Chunk) bool {
 	if c.Offset != other.Offset {
 		return false
 	}
-	if c.Hash != other.Hash {
+	if c.Weak != other.Weak {
 		return false
 	}
-	if !bytes.Equal(c.Data, other.Data) {
+	if !bytes.Equal(c.Strong, other.Strong) {
 		return false
 	}
 	return true
 }
 
+// SameContent reports whether both chunks hold the same data, judging by their digests.
+// Unlike ValidateChunk it ignores the position of the chunks in their files.
+func (c *Chunk) SameContent(other *Chunk) bool {
+	return c.Length == other.Length && c.Weak == other.Weak && bytes.Equal(c.Strong, other.Strong)
+}
+
 // Print prints the chunk
 func (c *Chunk) Print() {
-	fmt.Printf("Data: %v\n", c.Data)
-	fmt.Printf("Hash: %d\n", c.Hash)
+	fmt.Printf("Weak: %08x\n", c.Weak)
+	fmt.Printf("Strong: %x\n", c.Strong)
 	fmt.Printf("Offset: %d\n", c.Offset)
 	fmt.Printf("Length: %d\n", c.Length)
 }
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// ChunkID identifies a chunk of file content by the SHA-256 digest of its data. Identical
+// chunks have the same ID, so a chunk store keeps each of them once.
+type ChunkID [sha256.Size]byte
+
+// NewChunkID returns the ID of the given data
+func NewChunkID(data []byte) ChunkID {
+	return sha256.Sum256(data)
+}
+
+// String returns the ID in hexadecimal
+func (id ChunkID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ChunkStats describes the content held by a chunk store
+type ChunkStats struct {
+	Chunks       int64 // number of distinct chunks
+	Bytes        int64 // bytes stored, each chunk counted once
+	References   int64 // number of references to the chunks
+	LogicalBytes int64 // bytes referenced, each chunk counted once per reference
+}
@@ -2,27 +2,170 @@ package models
 
 import (
 	"fmt"
+	"sort"
 )
 
-// Delta represents a delta between two files
+// OpKind is the kind of a delta instruction
+type OpKind uint8
+
+const (
+	// OpCopy copies Length bytes starting at Offset from the original file
+	OpCopy OpKind = iota + 1
+	// OpLiteral writes Data, which is not found in the original file
+	OpLiteral
+	// OpEnd marks the end of the instruction stream
+	OpEnd
+)
+
+// String returns the name of the instruction kind
+func (k OpKind) String() string {
+	switch k {
+	case OpCopy:
+		return "COPY"
+	case OpLiteral:
+		return "LITERAL"
+	case OpEnd:
+		return "END"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Op is a single delta instruction. Applying all instructions of a delta in order
+// to the original file produces the updated file. The instructions are positional:
+// each one appends to the output, so copies can be reordered, repeated or dropped
+// and the updated file can be shorter than the original one.
+type Op struct {
+	Kind   OpKind // the kind of instruction
+	Offset int64  // the offset in the original file to copy from, for OpCopy
+	Length int64  // the number of bytes produced by the instruction
+	Data   []byte // the literal bytes, for OpLiteral
+}
+
+// Delta represents a delta between two files as a stream of instructions terminated by OpEnd
 type Delta struct {
-	Added    []Chunk           // list of chunks that have been added
-	Modified []Chunk           // list of chunks that have been modified
-	Metadata map[string]string // metadata needed to apply the changes to the original signature
+	Ops          []Op   // instructions that rebuild the updated file from the original
+	TargetLength int64  // length of the updated file in bytes
+	Checksum     []byte // SHA-256 digest of the updated file
+}
+
+// AddCopy appends a COPY instruction, merging it with the previous one when both are contiguous
+func (d *Delta) AddCopy(offset, length int64) {
+	if length == 0 {
+		return
+	}
+	if n := len(d.Ops); n > 0 {
+		last := &d.Ops[n-1]
+		if last.Kind == OpCopy && last.Offset+last.Length == offset {
+			last.Length += length
+			return
+		}
+	}
+	d.Ops = append(d.Ops, Op{Kind: OpCopy, Offset: offset, Length: length})
+}
+
+// AddLiteral appends a LITERAL instruction, merging it with the previous one when possible.
+// The data is copied so the caller can reuse its buffer.
+func (d *Delta) AddLiteral(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if n := len(d.Ops); n > 0 {
+		last := &d.Ops[n-1]
+		if last.Kind == OpLiteral {
+			last.Data = append(last.Data, data...)
+			last.Length += int64(len(data))
+			return
+		}
+	}
+	d.Ops = append(d.Ops, Op{Kind: OpLiteral, Length: int64(len(data)), Data: append([]byte(nil), data...)})
+}
+
+// End terminates the instruction stream
+func (d *Delta) End() {
+	d.Ops = append(d.Ops, Op{Kind: OpEnd})
+}
+
+// LiteralBytes returns the number of literal bytes carried by the delta, 0 for a nil delta
+func (d *Delta) LiteralBytes() int64 {
+	if d == nil {
+		return 0
+	}
+	var n int64
+	for _, op := range d.Ops {
+		if op.Kind == OpLiteral {
+			n += op.Length
+		}
+	}
+	return n
 }
 
 // Print prints the delta to stdout
 func (d *Delta) Print() {
-	fmt.Println("Added chunks:")
-	for _, chunk := range d.Added {
-		fmt.Printf("  start: %d, data: %s\n", chunk.Offset, chunk.Data)
+	fmt.Println("Instructions:")
+	for _, op := range d.Ops {
+		switch op.Kind {
+		case OpCopy:
+			fmt.Printf("  %s offset: %d, length: %d\n", op.Kind, op.Offset, op.Length)
+		case OpEnd:
+			fmt.Printf("  %s\n", op.Kind)
+		default:
+			fmt.Printf("  %s length: %d\n", op.Kind, op.Length)
+		}
 	}
-	fmt.Println("Modified chunks:")
-	for _, chunk := range d.Modified {
-		fmt.Printf("  start: %d, data: %s\n", chunk.Offset, chunk.Data)
+	fmt.Println("Target length: ", d.TargetLength)
+	fmt.Printf("Checksum: %x\n", d.Checksum)
+}
+
+// ComposeDeltas merges the delta d1, from file A to file B, and the delta d2, from file B to
+// file C, into one delta from file A to file C, without rebuilding file B. The COPY instructions
+// of d2 read from file B, they are resolved through the instructions of d1 into copies from file
+// A and literals of d1.
+func ComposeDeltas(d1, d2 *Delta) (*Delta, error) {
+	// starts holds the offset in file B at which each instruction of d1 begins
+	starts := make([]int64, len(d1.Ops)+1)
+	for i, op := range d1.Ops {
+		if op.Kind == OpEnd {
+			starts = starts[:i+1]
+			break
+		}
+		starts[i+1] = starts[i] + op.Length
 	}
-	fmt.Println("Metadata:")
-	for key, value := range d.Metadata {
-		fmt.Printf("  %s: %s\n", key, value)
+	length := starts[len(starts)-1]
+
+	composed := &Delta{Ops: make([]Op, 0), TargetLength: d2.TargetLength, Checksum: d2.Checksum}
+	for _, op := range d2.Ops {
+		switch op.Kind {
+		case OpCopy:
+			if op.Offset < 0 || op.Offset+op.Length > length {
+				return nil, fmt.Errorf("copy of %d bytes at offset %d is beyond the %d bytes of the intermediate file", op.Length, op.Offset, length)
+			}
+
+			// the instruction of d1 producing the first byte of the copy
+			i := sort.Search(len(starts)-1, func(i int) bool { return starts[i+1] > op.Offset })
+			for offset, end := op.Offset, op.Offset+op.Length; offset < end; i++ {
+				src := d1.Ops[i]
+				skip := offset - starts[i]
+				n := src.Length - skip
+				if rest := end - offset; rest < n {
+					n = rest
+				}
+				switch src.Kind {
+				case OpCopy:
+					composed.AddCopy(src.Offset+skip, n)
+				case OpLiteral:
+					composed.AddLiteral(src.Data[skip : skip+n])
+				}
+				offset += n
+			}
+		case OpLiteral:
+			composed.AddLiteral(op.Data)
+		case OpEnd:
+			composed.End()
+			return composed, nil
+		default:
+			return nil, fmt.Errorf("unknown delta instruction: %d", op.Kind)
+		}
 	}
+	return nil, fmt.Errorf("delta is missing its END instruction")
 }
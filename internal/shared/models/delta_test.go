@@ -0,0 +1,109 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/hungaikev/rdiff/internal/pkg/apply"
+	"github.com/hungaikev/rdiff/internal/pkg/diff"
+	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// compare returns the delta from original to updated
+func compare(t *testing.T, original, updated []byte) *models.Delta {
+	t.Helper()
+
+	ctx := context.Background()
+	log := zerolog.Nop()
+	sig, err := signature.GenerateFromReader(ctx, bytes.NewReader(original), &log, signature.WithBlockSize(64))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delta, err := diff.Compare(ctx, sig, bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return delta
+}
+
+// patch applies the delta to the basis file
+func patch(t *testing.T, basis []byte, delta *models.Delta) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	if _, err := apply.Rebuild(context.Background(), bytes.NewReader(basis), delta, &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestComposeDeltas(t *testing.T) {
+	random := func(n int, seed int64) []byte {
+		b := make([]byte, n)
+		rand.New(rand.NewSource(seed)).Read(b)
+		return b
+	}
+
+	a := random(4096, 1)
+
+	// b moves the second half of a to the front and inserts new bytes in the middle
+	b := append(append(append([]byte(nil), a[2048:]...), random(100, 2)...), a[:2048]...)
+
+	tests := []struct {
+		name string
+		c    []byte
+	}{
+		{"identical", b},
+		{"copies across instructions", append(append([]byte(nil), b[1000:3000]...), b[:500]...)},
+		{"inserted bytes only", b[2048:2148]},
+		{"appended", append(append([]byte(nil), b...), "appended"...)},
+		{"unrelated", random(3000, 3)},
+		{"empty", []byte{}},
+	}
+
+	d1 := compare(t, a, b)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d2 := compare(t, b, tt.c)
+
+			composed, err := models.ComposeDeltas(d1, d2)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			twice := patch(t, patch(t, a, d1), d2)
+			if got := patch(t, a, composed); !bytes.Equal(got, twice) || !bytes.Equal(got, tt.c) {
+				t.Errorf("composed delta does not rebuild the same file as both deltas")
+			}
+			if composed.LiteralBytes() > d1.LiteralBytes()+d2.LiteralBytes() {
+				t.Errorf("unexpected literal bytes: got %d, want at most %d", composed.LiteralBytes(), d1.LiteralBytes()+d2.LiteralBytes())
+			}
+		})
+	}
+}
+
+func TestComposeDeltasInvalid(t *testing.T) {
+	d1 := &models.Delta{Ops: []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}, {Kind: models.OpEnd}}, TargetLength: 8}
+
+	tests := []struct {
+		name string
+		ops  []models.Op
+	}{
+		{"copy beyond the intermediate file", []models.Op{{Kind: models.OpCopy, Offset: 4, Length: 8}, {Kind: models.OpEnd}}},
+		{"missing END", []models.Op{{Kind: models.OpCopy, Offset: 0, Length: 8}}},
+		{"unknown instruction", []models.Op{{Kind: 42}, {Kind: models.OpEnd}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := models.ComposeDeltas(d1, &models.Delta{Ops: tt.ops}); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ListOrder is the order of the files listed by a storage
+type ListOrder uint8
+
+const (
+	// OrderByPath lists the files by path, in byte order
+	OrderByPath ListOrder = iota
+	// OrderByModified lists the most recently modified files first, files modified at the same
+	// time by path
+	OrderByModified
+)
+
+// ListFilter selects and orders the files listed by a storage
+type ListFilter struct {
+	Prefix  string    // only files whose path starts with Prefix are listed
+	OrderBy ListOrder // order of the files
+}
+
+// Match reports whether the filter selects the file of the signature
+func (f ListFilter) Match(s *Signature) bool {
+	return strings.HasPrefix(s.FilePath, f.Prefix)
+}
+
+// Less reports whether the file of a is listed before the file of b
+func (f ListFilter) Less(a, b *Signature) bool {
+	if f.OrderBy == OrderByModified {
+		ma, mb := a.ModifiedAt(), b.ModifiedAt()
+		if !ma.Equal(mb) {
+			return ma.After(mb)
+		}
+	}
+	return a.FilePath < b.FilePath
+}
+
+// ModifiedAt returns the time the file was last recorded, the time its signature was created
+// when it has not been updated since
+func (s *Signature) ModifiedAt() time.Time {
+	if s.LastModified.After(s.CreatedAt) {
+		return s.LastModified
+	}
+	return s.CreatedAt
+}
+
+// pageToken is the position of a listing after the last file of a page
+type pageToken struct {
+	Order    ListOrder `json:"o"`
+	Path     string    `json:"p"`
+	Modified int64     `json:"m,omitempty"`
+}
+
+// PageToken returns the token listing the files after the file of the signature, the last file
+// of a page
+func (f ListFilter) PageToken(last *Signature) string {
+	token := pageToken{Order: f.OrderBy, Path: last.FilePath}
+	if f.OrderBy == OrderByModified {
+		token.Modified = last.ModifiedAt().UnixNano()
+	}
+	b, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// After decodes a token returned by PageToken. It returns the position of the listing as a
+// signature: the files f.Less lists after it are on the next page. An empty token starts the
+// listing and returns nil.
+func (f ListFilter) After(token string) (*Signature, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token: %w", err)
+	}
+	var t pageToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("invalid page token: %w", err)
+	}
+	if t.Order != f.OrderBy {
+		return nil, fmt.Errorf("invalid page token: it lists files in another order")
+	}
+
+	after := &Signature{FilePath: t.Path}
+	if t.Order == OrderByModified {
+		after.CreatedAt = time.Unix(0, t.Modified)
+	}
+	return after, nil
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy selects the versions of a file kept by garbage collection. A version is kept
+// when any of the rules keeps it. The latest version of a file is always kept.
+type RetentionPolicy struct {
+	KeepLast      int       // number of latest versions of each file kept
+	KeepNewerThan time.Time // versions created after this time are kept, the zero time keeps none
+	KeepTagged    bool      // tagged versions are kept
+}
+
+// Retain returns the numbers of the versions the policy keeps among the given versions of a
+// file, oldest first. A version is restored from the closest snapshot before it, so every
+// version between a kept version and that snapshot is kept too.
+func (p RetentionPolicy) Retain(versions []*Version) map[int]bool {
+	keep := make(map[int]bool, len(versions))
+	for i, v := range versions {
+		latest := len(versions)-i <= p.KeepLast || i == len(versions)-1
+		recent := !p.KeepNewerThan.IsZero() && v.CreatedAt.After(p.KeepNewerThan)
+		tagged := p.KeepTagged && len(v.Tags) > 0
+		if latest || recent || tagged {
+			keep[v.Number] = true
+		}
+	}
+
+	needed := false
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if keep[v.Number] {
+			needed = true
+		}
+		if needed {
+			keep[v.Number] = true
+		}
+		if v.IsKeyframe() {
+			needed = false
+		}
+	}
+	return keep
+}
+
+// GCReport describes what garbage collection removed, or would remove in a dry run
+type GCReport struct {
+	DryRun     bool
+	Files      int   // files examined
+	Versions   int   // versions removed
+	Chunks     int64 // chunks removed from the chunk store
+	ChunkBytes int64 // content of the removed chunks
+	DeltaBytes int64 // literal bytes of the deltas of the removed versions
+}
+
+// Reclaimable returns the number of bytes freed by the collection
+func (r *GCReport) Reclaimable() int64 {
+	return r.ChunkBytes + r.DeltaBytes
+}
+
+// Print prints the report to stdout
+func (r *GCReport) Print() {
+	verb := "Removed"
+	if r.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Println("Files examined: ", r.Files)
+	fmt.Printf("%s %d versions and %d chunks\n", verb, r.Versions, r.Chunks)
+	fmt.Printf("Reclaimable: %d bytes (%d bytes of chunks, %d bytes of deltas)\n", r.Reclaimable(), r.ChunkBytes, r.DeltaBytes)
+}
@@ -0,0 +1,54 @@
+package models_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+func TestRetain(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 8 versions a day apart, with snapshots of versions 1 and 5 and a tag on version 2
+	var versions []*models.Version
+	for n := 1; n <= 8; n++ {
+		v := &models.Version{Number: n, CreatedAt: start.AddDate(0, 0, n)}
+		if n == 1 || n == 5 {
+			v.SnapshotChunks = []models.ChunkID{}
+		}
+		if n == 2 {
+			v.Tags = []string{"release"}
+		}
+		versions = append(versions, v)
+	}
+
+	tests := []struct {
+		name   string
+		policy models.RetentionPolicy
+		want   []int
+	}{
+		{"latest", models.RetentionPolicy{}, []int{5, 6, 7, 8}},
+		{"last", models.RetentionPolicy{KeepLast: 5}, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"last after snapshot", models.RetentionPolicy{KeepLast: 4}, []int{5, 6, 7, 8}},
+		{"newer", models.RetentionPolicy{KeepNewerThan: start.AddDate(0, 0, 4)}, []int{5, 6, 7, 8}},
+		{"newer before snapshot", models.RetentionPolicy{KeepNewerThan: start.AddDate(0, 0, 3)}, []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"tagged", models.RetentionPolicy{KeepTagged: true}, []int{1, 2, 5, 6, 7, 8}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := tt.policy.Retain(versions)
+			var got []int
+			for _, v := range versions {
+				if keep[v.Number] {
+					got = append(got, v.Number)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("unexpected versions kept: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,29 +1,120 @@
 package models
 
 import (
+	"bytes"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// WeakHash identifies the rolling checksum used for the weak hash of the chunks
+type WeakHash uint8
+
+const (
+	// WeakHashAdler32 is the rsync/librsync Adler-32 style checksum
+	WeakHashAdler32 WeakHash = iota + 1
+	// WeakHashRabinKarp is the librsync Rabin-Karp polynomial checksum
+	WeakHashRabinKarp
+)
+
+// String returns the name of the weak hash algorithm
+func (h WeakHash) String() string {
+	switch h {
+	case WeakHashAdler32:
+		return "adler32"
+	case WeakHashRabinKarp:
+		return "rabinkarp"
+	default:
+		return "unknown"
+	}
+}
+
+// StrongHash identifies the algorithm used for the strong digest of the chunks
+type StrongHash uint8
+
+const (
+	// StrongHashSHA256 digests chunks with SHA-256
+	StrongHashSHA256 StrongHash = iota + 1
+	// StrongHashBLAKE2b digests chunks with BLAKE2b-256
+	StrongHashBLAKE2b
+	// StrongHashMD4 digests chunks with MD4. It is only meant for compatibility with older librsync signatures.
+	StrongHashMD4
+)
+
+// String returns the name of the strong hash algorithm
+func (h StrongHash) String() string {
+	switch h {
+	case StrongHashSHA256:
+		return "sha256"
+	case StrongHashBLAKE2b:
+		return "blake2b"
+	case StrongHashMD4:
+		return "md4"
+	default:
+		return "unknown"
+	}
+}
+
+// Chunking identifies the algorithm that splits a file into chunks
+type Chunking uint8
+
+const (
+	// ChunkingFixed cuts chunks at fixed block boundaries, as rsync does. It is the zero value,
+	// so signatures that do not record their chunking use fixed blocks.
+	ChunkingFixed Chunking = iota
+	// ChunkingFastCDC cuts chunks where the content matches, using FastCDC with a gear hash
+	ChunkingFastCDC
+)
+
+// String returns the name of the chunking algorithm
+func (c Chunking) String() string {
+	switch c {
+	case ChunkingFixed:
+		return "fixed"
+	case ChunkingFastCDC:
+		return "fastcdc"
+	default:
+		return "unknown"
+	}
+}
+
+// ChunkSizes are the minimum, average and maximum chunk sizes in bytes of content-defined chunking
+type ChunkSizes struct {
+	Min int
+	Avg int
+	Max int
+}
+
 // Signature represents a file signature
 type Signature struct {
-	ID           uuid.UUID // unique identifier for the signature
-	FileSize     int64     // size of the file in bytes
-	FilePath     string    // path to the file
-	LastModified time.Time // last modified timestamp
-	CreatedAt    time.Time // timestamp for when the signature was created
-	Chunks       []Chunk   // chunks of the file
+	ID           uuid.UUID  // unique identifier for the signature
+	FileSize     int64      // size of the file in bytes
+	Checksum     []byte     // SHA-256 digest of the whole file
+	FilePath     string     // path to the file
+	LastModified time.Time  // last modified timestamp
+	CreatedAt    time.Time  // timestamp for when the signature was created
+	WeakHash     WeakHash   // rolling checksum of the chunks
+	StrongHash   StrongHash // algorithm of the strong digest of the chunks
+	StrongLen    int        // length in bytes the strong digests are truncated to
+	BlockSize    int        // size in bytes of the blocks of fixed chunking
+	Chunking     Chunking   // algorithm that split the file into chunks
+	ChunkSizes   ChunkSizes // chunk sizes of content-defined chunking
+	Chunks       []Chunk    // chunks of the file
 }
 
 // Print prints the signature to stdout
 func (s *Signature) Print() {
 	fmt.Println("ID: ", s.ID)
 	fmt.Println("File size: ", s.FileSize)
+	fmt.Printf("Checksum: %x\n", s.Checksum)
 	fmt.Println("File path: ", s.FilePath)
 	fmt.Println("Last modified: ", s.LastModified)
 	fmt.Println("Created at: ", s.CreatedAt)
+	fmt.Println("Weak hash: ", s.WeakHash)
+	fmt.Println("Strong hash: ", s.StrongHash, s.StrongLen)
+	fmt.Println("Chunking: ", s.Chunking)
+	fmt.Println("Block size: ", s.BlockSize)
 	fmt.Println("Number of chunks: ", len(s.Chunks))
 	for _, chunk := range s.Chunks {
 		chunk.Print()
@@ -32,7 +123,8 @@ func (s *Signature) Print() {
 
 // ValidateSignature validates the given signature
 func (s *Signature) ValidateSignature(other *Signature) bool {
-	if s.FileSize != other.FileSize || s.LastModified != other.LastModified || s.CreatedAt != other.CreatedAt || len(s.Chunks) != len(other.Chunks) {
+	if s.FileSize != other.FileSize || !bytes.Equal(s.Checksum, other.Checksum) || s.LastModified != other.LastModified || s.CreatedAt != other.CreatedAt ||
+		s.WeakHash != other.WeakHash || s.StrongHash != other.StrongHash || s.StrongLen != other.StrongLen || s.BlockSize != other.BlockSize || s.Chunking != other.Chunking || s.ChunkSizes != other.ChunkSizes || len(s.Chunks) != len(other.Chunks) {
 		return false
 	}
 	for i := range s.Chunks {
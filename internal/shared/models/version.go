@@ -0,0 +1,75 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultKeyframeInterval is the number of versions between two full snapshots of a file
+const DefaultKeyframeInterval = 10
+
+// KeyframeAt reports whether version n gets a snapshot when the full content of a file is
+// stored every k versions, starting with the first one
+func KeyframeAt(n, k int) bool {
+	return k <= 1 || (n-1)%k == 0
+}
+
+// Version is one version in the history of a tracked file
+type Version struct {
+	Number    int        // position in the history of the file, starting at 1, kept when older versions are removed
+	FilePath  string     // path of the file
+	CreatedAt time.Time  // time the version was recorded
+	Signature *Signature // signature of the file at this version
+	Delta     *Delta     // instructions rebuilding this version from the previous one, nil for a first version
+	Reverse   *Delta     // instructions rebuilding the previous version from this one, nil when unknown
+	Snapshot  []byte     // full content of the file at this version, nil unless the version is a keyframe
+	Tags      []string   // labels of the version, tagged versions can be kept by garbage collection
+
+	// SnapshotChunks are the chunks of the snapshot in the chunk store of the storage, which
+	// keeps content shared between snapshots once
+	SnapshotChunks []ChunkID
+
+	// Content is the full content of the file at this version, stored as the snapshot of a
+	// keyframe in place of Snapshot. The storage reads it as it stores it, so large files are
+	// never held in memory as a whole.
+	Content io.Reader
+}
+
+// IsKeyframe reports whether the version has a snapshot, stored inline or in the chunk store
+func (v *Version) IsKeyframe() bool {
+	return v.Content != nil || v.Snapshot != nil || v.SnapshotChunks != nil
+}
+
+// SnapshotReader returns the content of the snapshot to store, read from Content or Snapshot,
+// or nil unless the version is a keyframe
+func (v *Version) SnapshotReader() io.Reader {
+	if v.Content != nil {
+		return v.Content
+	}
+	if v.Snapshot != nil {
+		return bytes.NewReader(v.Snapshot)
+	}
+	return nil
+}
+
+// Print prints the version to stdout
+func (v *Version) Print() {
+	fmt.Println("Version: ", v.Number)
+	fmt.Println("File path: ", v.FilePath)
+	fmt.Println("Created at: ", v.CreatedAt)
+	if len(v.Tags) > 0 {
+		fmt.Println("Tags: ", strings.Join(v.Tags, ", "))
+	}
+	if v.Delta != nil {
+		fmt.Printf("Delta: %d instructions, %d literal bytes\n", len(v.Delta.Ops), v.Delta.LiteralBytes())
+	}
+	if v.Snapshot != nil {
+		fmt.Printf("Snapshot: %d bytes\n", len(v.Snapshot))
+	}
+	if v.Reverse != nil {
+		fmt.Printf("Reverse delta: %d instructions, %d literal bytes\n", len(v.Reverse.Ops), v.Reverse.LiteralBytes())
+	}
+}
@@ -0,0 +1,213 @@
+// Package chunkstore implements a content-addressed store of file content with reference counts
+package chunkstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/hungaikev/rdiff/internal/pkg/chunks"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+// Split cuts data into content-defined chunks, so that content shared by two files, even at
+// different offsets, is cut into the same chunks. The chunks are slices of data.
+func Split(data []byte) ([][]byte, error) {
+	var parts [][]byte
+	var offset int
+	err := SplitReader(bytes.NewReader(data), func(chunk []byte) error {
+		parts = append(parts, data[offset:offset+len(chunk)])
+		offset += len(chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// SplitReader cuts the content read from r into chunks like Split and calls fn with each chunk
+// as it is read, so the content is never held in memory as a whole. The chunk is only valid
+// until fn returns.
+func SplitReader(r io.Reader, fn func(chunk []byte) error) error {
+	chunker, err := chunks.NewFastCDC(r, chunks.DefaultChunkSizes)
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error splitting content: %w", err)
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+// Join concatenates the data of the given chunks, read with get
+func Join(ids []models.ChunkID, get func(id models.ChunkID) ([]byte, error)) ([]byte, error) {
+	data := make([]byte, 0)
+	for _, id := range ids {
+		chunk, err := get(id)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// entry is a chunk of the store
+type entry struct {
+	data []byte
+	refs int64
+}
+
+// Store is an in-memory chunk store. A chunk is kept once no matter how many times it is
+// put, and removed once every reference to it has been released. Store is not safe for
+// concurrent use.
+type Store struct {
+	chunks map[models.ChunkID]*entry
+}
+
+// New creates an empty chunk store
+func New() *Store {
+	return &Store{chunks: make(map[models.ChunkID]*entry)}
+}
+
+// Put splits data into chunks, adds a reference to each of them and returns their IDs
+func (s *Store) Put(data []byte) ([]models.ChunkID, error) {
+	return s.PutReader(bytes.NewReader(data))
+}
+
+// PutReader is Put for the content read from r
+func (s *Store) PutReader(r io.Reader) ([]models.ChunkID, error) {
+	var ids []models.ChunkID
+	err := SplitReader(r, func(chunk []byte) error {
+		id := models.NewChunkID(chunk)
+		e, ok := s.chunks[id]
+		if !ok {
+			e = &entry{data: append([]byte(nil), chunk...)}
+			s.chunks[id] = e
+		}
+		e.refs++
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		// the chunks put so far are released, the store is left as it was
+		s.Release(ids)
+		return nil, err
+	}
+	if ids == nil {
+		ids = []models.ChunkID{}
+	}
+	return ids, nil
+}
+
+// Get returns the data of the given chunks, concatenated
+func (s *Store) Get(ids []models.ChunkID) ([]byte, error) {
+	return Join(ids, func(id models.ChunkID) ([]byte, error) {
+		e, ok := s.chunks[id]
+		if !ok {
+			return nil, fmt.Errorf("chunk %s not found", id)
+		}
+		return e.data, nil
+	})
+}
+
+// Release drops a reference to each of the given chunks
+func (s *Store) Release(ids []models.ChunkID) {
+	for _, id := range ids {
+		e, ok := s.chunks[id]
+		if !ok {
+			continue
+		}
+		if e.refs--; e.refs <= 0 {
+			delete(s.chunks, id)
+		}
+	}
+}
+
+// Stats describes the content of the store
+func (s *Store) Stats() models.ChunkStats {
+	var stats models.ChunkStats
+	for _, e := range s.chunks {
+		stats.Chunks++
+		stats.Bytes += int64(len(e.data))
+		stats.References += e.refs
+		stats.LogicalBytes += e.refs * int64(len(e.data))
+	}
+	return stats
+}
+
+// Marks counts the references to chunks found while walking the snapshots that are kept
+type Marks map[models.ChunkID]int64
+
+// Add marks a reference to each of the given chunks
+func (m Marks) Add(ids []models.ChunkID) {
+	for _, id := range ids {
+		m[id]++
+	}
+}
+
+// Sweep sets the reference count of every chunk to its number of marks and removes the chunks
+// without any. It returns the number of chunks removed and their size. With dryRun the store is
+// left unchanged and the result is what would be removed.
+func (s *Store) Sweep(marks Marks, dryRun bool) (chunks, bytes int64) {
+	for id, e := range s.chunks {
+		refs := marks[id]
+		if refs > 0 {
+			if !dryRun {
+				e.refs = refs
+			}
+			continue
+		}
+		chunks++
+		bytes += int64(len(e.data))
+		if !dryRun {
+			delete(s.chunks, id)
+		}
+	}
+	return chunks, bytes
+}
+
+// idsFormat is the first byte of an encoded chunk list. It keeps an empty list from encoding to
+// an empty value, which some databases read back as NULL.
+const idsFormat = 1
+
+// EncodeIDs encodes the given IDs for storage. A nil list is encoded as nil, so that stores can
+// tell an empty snapshot from a missing one.
+func EncodeIDs(ids []models.ChunkID) []byte {
+	if ids == nil {
+		return nil
+	}
+	b := make([]byte, 1, 1+len(ids)*len(models.ChunkID{}))
+	b[0] = idsFormat
+	for _, id := range ids {
+		b = append(b, id[:]...)
+	}
+	return b
+}
+
+// DecodeIDs is the inverse of EncodeIDs
+func DecodeIDs(b []byte) ([]models.ChunkID, error) {
+	if b == nil {
+		return nil, nil
+	}
+	size := len(models.ChunkID{})
+	if len(b) == 0 || b[0] != idsFormat || (len(b)-1)%size != 0 {
+		return nil, fmt.Errorf("invalid chunk list: %d bytes", len(b))
+	}
+	b = b[1:]
+	ids := make([]models.ChunkID, len(b)/size)
+	for i := range ids {
+		copy(ids[i][:], b[i*size:])
+	}
+	return ids, nil
+}
@@ -0,0 +1,142 @@
+package chunkstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+)
+
+func TestStore(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	s := New()
+	first, err := s.Put(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := s.Put(append([]byte("prefix"), data...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats := s.Stats()
+	if stats.LogicalBytes != int64(2*len(data)+len("prefix")) {
+		t.Errorf("unexpected logical bytes: %d", stats.LogicalBytes)
+	}
+	if stats.Bytes > int64(len(data))+65536 {
+		t.Errorf("shared content is not deduplicated: %d bytes stored", stats.Bytes)
+	}
+
+	if got, err := s.Get(first); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("unexpected content: %d bytes, %v", len(got), err)
+	}
+
+	// the chunks of the second file are kept until it is released too
+	s.Release(first)
+	if got, err := s.Get(second); err != nil || !bytes.Equal(got[len("prefix"):], data) {
+		t.Errorf("unexpected content after releasing the first file: %d bytes, %v", len(got), err)
+	}
+	s.Release(second)
+	if stats := s.Stats(); stats != (models.ChunkStats{}) {
+		t.Errorf("unexpected stats after releasing everything: %+v", stats)
+	}
+}
+
+func TestSplitReader(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	parts, err := Split(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// short reads cut the content into the same chunks
+	var streamed [][]byte
+	err = SplitReader(iotest.HalfReader(bytes.NewReader(data)), func(chunk []byte) error {
+		streamed = append(streamed, append([]byte(nil), chunk...))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(streamed) != len(parts) {
+		t.Fatalf("unexpected number of chunks: %d, want %d", len(streamed), len(parts))
+	}
+	for i := range parts {
+		if !bytes.Equal(streamed[i], parts[i]) {
+			t.Errorf("chunk %d differs", i)
+		}
+	}
+
+	// a failed read leaves the store as it was
+	s := New()
+	failing := io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errors.New("read failed")))
+	if _, err := s.PutReader(failing); err == nil {
+		t.Errorf("expected an error for a failed read")
+	}
+	if stats := s.Stats(); stats != (models.ChunkStats{}) {
+		t.Errorf("unexpected stats after a failed put: %+v", stats)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s := New()
+	kept, err := s.Put([]byte("kept"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.Put([]byte("dropped")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a reference leaked by a previous run
+	if _, err := s.Put([]byte("kept")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	marks := Marks{}
+	marks.Add(kept)
+
+	before := s.Stats()
+	if chunks, bytes := s.Sweep(marks, true); chunks != 1 || bytes != int64(len("dropped")) {
+		t.Errorf("unexpected dry run: %d chunks, %d bytes", chunks, bytes)
+	}
+	if stats := s.Stats(); stats != before {
+		t.Errorf("dry run modified the store: %+v, want %+v", stats, before)
+	}
+
+	if chunks, bytes := s.Sweep(marks, false); chunks != 1 || bytes != int64(len("dropped")) {
+		t.Errorf("unexpected sweep: %d chunks, %d bytes", chunks, bytes)
+	}
+	want := models.ChunkStats{Chunks: 1, Bytes: 4, References: 1, LogicalBytes: 4}
+	if stats := s.Stats(); stats != want {
+		t.Errorf("unexpected stats after the sweep: %+v, want %+v", stats, want)
+	}
+}
+
+func TestEncodeIDs(t *testing.T) {
+	for _, ids := range [][]models.ChunkID{nil, {}, {models.NewChunkID([]byte("a")), models.NewChunkID([]byte("b"))}} {
+		got, err := DecodeIDs(EncodeIDs(ids))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if (got == nil) != (ids == nil) || len(got) != len(ids) {
+			t.Errorf("unexpected IDs: got %v, want %v", got, ids)
+		}
+		for i := range ids {
+			if got[i] != ids[i] {
+				t.Errorf("unexpected ID %d: got %s, want %s", i, got[i], ids[i])
+			}
+		}
+	}
+
+	if _, err := DecodeIDs([]byte{idsFormat, 1, 2}); err == nil {
+		t.Errorf("expected an error for a truncated list")
+	}
+}
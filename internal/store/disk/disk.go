@@ -0,0 +1,860 @@
+// Package disk implements the storage interface on local disk, in a bbolt database file
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/chunkstore"
+)
+
+// Buckets of the database. Signatures are keyed by ID. Versions and the chunk lists of their
+// snapshots are kept in one nested bucket per file path, keyed by version number. The content
+// of the snapshots is kept in the chunks bucket, keyed by chunk ID, each value is the reference
+// count of the chunk followed by its data. The index bucket maps the hashes of the chunks of the
+// current signatures to the signatures holding them, see indexKey.
+var (
+	signaturesBucket = []byte("signatures")
+	versionsBucket   = []byte("versions")
+	snapshotsBucket  = []byte("snapshots")
+	chunksBucket     = []byte("chunks")
+	indexBucket      = []byte("index")
+)
+
+// Storage is the on-disk storage implementation
+type Storage struct {
+	db     *bolt.DB
+	log    *zerolog.Logger
+	tracer trace.Tracer
+}
+
+// Open opens the storage in the database file at path, creating it when it does not exist.
+// The file is locked until Close is called.
+func Open(path string, log *zerolog.Logger, tracer trace.Tracer) (*Storage, error) {
+	tracer = otel.Tracer("disk")
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// databases written before the index existed are indexed when they are first opened
+		indexed := tx.Bucket(indexBucket) != nil || tx.Bucket(signaturesBucket) == nil
+		for _, name := range [][]byte{signaturesBucket, versionsBucket, snapshotsBucket, chunksBucket, indexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if indexed {
+			return nil
+		}
+		return tx.Bucket(signaturesBucket).ForEach(func(_, v []byte) error {
+			var signature models.Signature
+			if err := decode(v, &signature); err != nil {
+				return err
+			}
+			return putSignature(tx, &signature)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating buckets: %w", err)
+	}
+
+	return &Storage{
+		db:     db,
+		log:    log,
+		tracer: tracer,
+	}, nil
+}
+
+// Close closes the database file
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Save saves the signature of the version and records the version as a new version of the file,
+// with its snapshot if any
+func (s *Storage) Save(ctx context.Context, version *models.Version) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.Save")
+	defer span.End()
+
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
+	signature.ID = uuid.New()
+	signature.CreatedAt = time.Now()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := putSignature(tx, signature); err != nil {
+			return err
+		}
+		return appendVersion(tx, signature.FilePath, version)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error saving signature: %w", err)
+	}
+	return version, nil
+}
+
+// Get returns the signature for the given id
+func (s *Storage) Get(ctx context.Context, id uuid.UUID) (*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.Get")
+	defer span.End()
+
+	var signature *models.Signature
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		signature, err = getSignature(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// Update records the given version of a file stored under the ID of its signature
+func (s *Storage) Update(ctx context.Context, version *models.Version) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.Update")
+	defer span.End()
+
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		current, err := getSignature(tx, signature.ID)
+		if err != nil {
+			return err
+		}
+
+		signature.LastModified = time.Now()
+		if err := putSignature(tx, signature); err != nil {
+			return err
+		}
+		return appendVersion(tx, current.FilePath, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// ChunkExists checks if a chunk exists
+func (s *Storage) ChunkExists(ctx context.Context, chunk models.Chunk) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.ChunkExists")
+	defer span.End()
+
+	var exists bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := chunkPrefix(&chunk)
+		k, _ := tx.Bucket(indexBucket).Cursor().Seek(prefix)
+		exists = k != nil && bytes.HasPrefix(k, prefix)
+		return nil
+	})
+	return exists, err
+}
+
+// GetSignatureForChunk returns the signatures that contain the given chunk
+func (s *Storage) GetSignatureForChunk(ctx context.Context, chunk models.Chunk) ([]*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.GetSignatureForChunk")
+	defer span.End()
+
+	var signatures []*models.Signature
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := chunkPrefix(&chunk)
+		seen := make(map[uuid.UUID]bool)
+
+		c := tx.Bucket(indexBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id, err := uuid.FromBytes(k[len(prefix) : len(prefix)+16])
+			if err != nil {
+				return fmt.Errorf("invalid index entry: %w", err)
+			}
+			// a signature holding the chunk several times is returned once
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			signature, err := getSignature(tx, id)
+			if err != nil {
+				return err
+			}
+			signatures = append(signatures, signature)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("signature not found")
+	}
+	return signatures, nil
+}
+
+// FileExists checks if a file exists
+func (s *Storage) FileExists(ctx context.Context, filename string) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.FileExists")
+	defer span.End()
+
+	var exists bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(versionsBucket).Bucket([]byte(filename)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// GetSignatureForFilename returns the signature of the latest version of the given file
+func (s *Storage) GetSignatureForFilename(ctx context.Context, filename string) (*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.GetSignatureForFilename")
+	defer span.End()
+
+	var signature *models.Signature
+	err := s.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(versionsBucket).Bucket([]byte(filename))
+		if versions == nil {
+			return fmt.Errorf("signature not found")
+		}
+		_, v := versions.Cursor().Last()
+
+		version := &models.Version{}
+		if err := decode(v, version); err != nil {
+			return err
+		}
+		signature = version.Signature
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// ListVersions returns the versions of the given file, oldest first, without snapshot content
+func (s *Storage) ListVersions(ctx context.Context, filename string) ([]*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.ListVersions")
+	defer span.End()
+
+	var history []*models.Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(versionsBucket).Bucket([]byte(filename)) == nil {
+			return fmt.Errorf("file not found")
+		}
+		var err error
+		history, err = getRecords(tx, filename)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// LatestVersion returns the number of the latest version of the given file
+func (s *Storage) LatestVersion(ctx context.Context, filename string) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.LatestVersion")
+	defer span.End()
+
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var k []byte
+		if versions := tx.Bucket(versionsBucket).Bucket([]byte(filename)); versions != nil {
+			k, _ = versions.Cursor().Last()
+		}
+		if k == nil {
+			return fmt.Errorf("file not found")
+		}
+		n = int(binary.BigEndian.Uint64(k))
+		return nil
+	})
+	return n, err
+}
+
+// GetVersion returns version n of the given file
+func (s *Storage) GetVersion(ctx context.Context, filename string, n int) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.GetVersion")
+	defer span.End()
+
+	var version *models.Version
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = getVersion(tx, filename, versionKey(n))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// SaveSnapshot records the full content of version n of the given file
+func (s *Storage) SaveSnapshot(ctx context.Context, filename string, n int, content io.Reader) error {
+	ctx, span := s.tracer.Start(ctx, "disk.SaveSnapshot")
+	defer span.End()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(versionsBucket).Bucket([]byte(filename))
+		if versions == nil || versions.Get(versionKey(n)) == nil {
+			return fmt.Errorf("version not found")
+		}
+
+		return putSnapshot(tx, filename, versionKey(n), content)
+	})
+}
+
+// ChunkStats describes the content of the snapshots held by the storage
+func (s *Storage) ChunkStats(ctx context.Context) (*models.ChunkStats, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.ChunkStats")
+	defer span.End()
+
+	stats := &models.ChunkStats{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chunksBucket).ForEach(func(_, v []byte) error {
+			refs := int64(binary.BigEndian.Uint64(v))
+			size := int64(len(v) - 8)
+			stats.Chunks++
+			stats.Bytes += size
+			stats.References += refs
+			stats.LogicalBytes += refs * size
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunks: %w", err)
+	}
+	return stats, nil
+}
+
+// TagVersion adds a tag to version n of the given file
+func (s *Storage) TagVersion(ctx context.Context, filename string, n int, tag string) error {
+	ctx, span := s.tracer.Start(ctx, "disk.TagVersion")
+	defer span.End()
+
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(versionsBucket).Bucket([]byte(filename))
+		var v []byte
+		if versions != nil {
+			v = versions.Get(versionKey(n))
+		}
+		if v == nil {
+			return fmt.Errorf("version not found")
+		}
+
+		record := &models.Version{}
+		if err := decode(v, record); err != nil {
+			return err
+		}
+		for _, t := range record.Tags {
+			if t == tag {
+				return nil
+			}
+		}
+		record.Tags = append(record.Tags, tag)
+
+		v, err := encode(record)
+		if err != nil {
+			return err
+		}
+		return versions.Put(versionKey(n), v)
+	})
+}
+
+// GC removes the versions the policy does not retain and the chunks no longer referenced
+func (s *Storage) GC(ctx context.Context, policy models.RetentionPolicy, dryRun bool) (*models.GCReport, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.GC")
+	defer span.End()
+
+	report := &models.GCReport{DryRun: dryRun}
+	collect := func(tx *bolt.Tx) error {
+		var files [][]byte
+		err := tx.Bucket(versionsBucket).ForEach(func(k, _ []byte) error {
+			files = append(files, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		marks := chunkstore.Marks{}
+		for _, filename := range files {
+			report.Files++
+			history, err := getRecords(tx, string(filename))
+			if err != nil {
+				return err
+			}
+
+			keep := policy.Retain(history)
+			for _, v := range history {
+				if keep[v.Number] {
+					marks.Add(v.SnapshotChunks)
+					continue
+				}
+				report.Versions++
+				report.DeltaBytes += v.Delta.LiteralBytes() + v.Reverse.LiteralBytes()
+				if dryRun {
+					continue
+				}
+				if err := tx.Bucket(versionsBucket).Bucket(filename).Delete(versionKey(v.Number)); err != nil {
+					return fmt.Errorf("error removing version: %w", err)
+				}
+				if snapshots := tx.Bucket(snapshotsBucket).Bucket(filename); snapshots != nil {
+					if err := snapshots.Delete(versionKey(v.Number)); err != nil {
+						return fmt.Errorf("error removing snapshot: %w", err)
+					}
+				}
+			}
+		}
+
+		report.Chunks, report.ChunkBytes, err = sweepChunks(tx, marks, dryRun)
+		return err
+	}
+
+	var err error
+	if dryRun {
+		err = s.db.View(collect)
+	} else {
+		err = s.db.Update(collect)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error collecting garbage: %w", err)
+	}
+
+	s.log.Info().Msgf("garbage collection: %d versions and %d chunks removed, %d bytes reclaimed, dry run %t",
+		report.Versions, report.Chunks, report.Reclaimable(), dryRun)
+	return report, nil
+}
+
+// Delete removes the signature with the given ID and the versions of its file
+func (s *Storage) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, span := s.tracer.Start(ctx, "disk.Delete")
+	defer span.End()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		signature, err := getSignature(tx, id)
+		if err != nil {
+			return err
+		}
+		return deleteFile(tx, signature.FilePath)
+	})
+}
+
+// DeleteByFilename removes the versions of the given file and their signatures
+func (s *Storage) DeleteByFilename(ctx context.Context, filename string) error {
+	ctx, span := s.tracer.Start(ctx, "disk.DeleteByFilename")
+	defer span.End()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(versionsBucket).Bucket([]byte(filename)) == nil {
+			return fmt.Errorf("file not found")
+		}
+		return deleteFile(tx, filename)
+	})
+}
+
+// List returns the current signatures of the files selected by the filter, a page at a time
+func (s *Storage) List(ctx context.Context, filter models.ListFilter, pageToken string, limit int) ([]*models.Signature, string, error) {
+	ctx, span := s.tracer.Start(ctx, "disk.List")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	after, err := filter.After(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the files are keys of the versions bucket, in path order: listing by path stops after the
+	// page, listing by modification time reads every file with the prefix
+	start := []byte(filter.Prefix)
+	if after != nil && filter.OrderBy == models.OrderByPath && after.FilePath > filter.Prefix {
+		start = []byte(after.FilePath)
+	}
+
+	var files []*models.Signature
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(versionsBucket).Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(filter.Prefix)); k, _ = c.Next() {
+			if filter.OrderBy == models.OrderByPath && len(files) > limit {
+				break
+			}
+
+			_, v := tx.Bucket(versionsBucket).Bucket(k).Cursor().Last()
+			version := &models.Version{}
+			if err := decode(v, version); err != nil {
+				return err
+			}
+			if after == nil || filter.Less(after, version.Signature) {
+				files = append(files, version.Signature)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return filter.Less(files[i], files[j])
+	})
+	if len(files) <= limit {
+		return files, "", nil
+	}
+	return files[:limit], filter.PageToken(files[limit-1]), nil
+}
+
+// deleteFile removes the versions of the file, releasing the chunks of their snapshots, and
+// the signatures they were recorded under
+func deleteFile(tx *bolt.Tx, filename string) error {
+	name := []byte(filename)
+
+	history, err := getRecords(tx, filename)
+	if err != nil {
+		return err
+	}
+	for _, v := range history {
+		if err := releaseChunks(tx, v.SnapshotChunks); err != nil {
+			return err
+		}
+		if v.Signature == nil {
+			continue
+		}
+		if err := unindex(tx, v.Signature.ID); err != nil {
+			return err
+		}
+		if err := tx.Bucket(signaturesBucket).Delete(v.Signature.ID[:]); err != nil {
+			return fmt.Errorf("error removing signature: %w", err)
+		}
+	}
+
+	if err := tx.Bucket(versionsBucket).DeleteBucket(name); err != nil {
+		return fmt.Errorf("error removing versions: %w", err)
+	}
+	if tx.Bucket(snapshotsBucket).Bucket(name) == nil {
+		return nil
+	}
+	if err := tx.Bucket(snapshotsBucket).DeleteBucket(name); err != nil {
+		return fmt.Errorf("error removing snapshots: %w", err)
+	}
+	return nil
+}
+
+// getRecords reads the versions of the given file, oldest first, with the chunks of their
+// snapshots but not their content
+func getRecords(tx *bolt.Tx, filename string) ([]*models.Version, error) {
+	snapshots := tx.Bucket(snapshotsBucket).Bucket([]byte(filename))
+
+	var history []*models.Version
+	err := tx.Bucket(versionsBucket).Bucket([]byte(filename)).ForEach(func(k, v []byte) error {
+		version := &models.Version{}
+		if err := decode(v, version); err != nil {
+			return err
+		}
+		if snapshots != nil {
+			ids, err := chunkstore.DecodeIDs(snapshots.Get(k))
+			if err != nil {
+				return err
+			}
+			version.SnapshotChunks = ids
+		}
+		history = append(history, version)
+		return nil
+	})
+	return history, err
+}
+
+// sweepChunks sets the reference count of every chunk to its number of marks and removes the
+// chunks without any, see chunkstore.Store.Sweep
+func sweepChunks(tx *bolt.Tx, marks chunkstore.Marks, dryRun bool) (chunks, size int64, err error) {
+	bucket := tx.Bucket(chunksBucket)
+
+	var removed, updated [][]byte
+	err = bucket.ForEach(func(k, v []byte) error {
+		var id models.ChunkID
+		copy(id[:], k)
+		refs := marks[id]
+		if refs == 0 {
+			chunks++
+			size += int64(len(v) - 8)
+			removed = append(removed, append([]byte(nil), k...))
+			return nil
+		}
+		if int64(binary.BigEndian.Uint64(v)) != refs {
+			updated = append(updated, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil || dryRun {
+		return chunks, size, err
+	}
+
+	// buckets can not be modified while they are iterated
+	for _, k := range removed {
+		if err := bucket.Delete(k); err != nil {
+			return 0, 0, fmt.Errorf("error removing chunk: %w", err)
+		}
+	}
+	for _, k := range updated {
+		var id models.ChunkID
+		copy(id[:], k)
+		v := append([]byte(nil), bucket.Get(k)...)
+		binary.BigEndian.PutUint64(v, uint64(marks[id]))
+		if err := bucket.Put(k, v); err != nil {
+			return 0, 0, fmt.Errorf("error updating chunk: %w", err)
+		}
+	}
+	return chunks, size, nil
+}
+
+// putSnapshot stores the content of a snapshot in the chunk store and records its chunks under
+// the key of the version, releasing the chunks of a previous snapshot
+func putSnapshot(tx *bolt.Tx, filename string, key []byte, content io.Reader) error {
+	chunks := tx.Bucket(chunksBucket)
+	ids := make([]models.ChunkID, 0)
+	err := chunkstore.SplitReader(content, func(part []byte) error {
+		id := models.NewChunkID(part)
+		v := chunks.Get(id[:])
+		if v == nil {
+			v = append(make([]byte, 8), part...)
+		} else {
+			v = append([]byte(nil), v...)
+		}
+		binary.BigEndian.PutUint64(v, binary.BigEndian.Uint64(v)+1)
+		if err := chunks.Put(id[:], v); err != nil {
+			return fmt.Errorf("error saving chunk: %w", err)
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := tx.Bucket(snapshotsBucket).CreateBucketIfNotExists([]byte(filename))
+	if err != nil {
+		return fmt.Errorf("error creating snapshots bucket: %w", err)
+	}
+	previous, err := chunkstore.DecodeIDs(snapshots.Get(key))
+	if err != nil {
+		return err
+	}
+	if err := releaseChunks(tx, previous); err != nil {
+		return err
+	}
+	return snapshots.Put(key, chunkstore.EncodeIDs(ids))
+}
+
+// releaseChunks drops a reference to each of the given chunks, removing the ones no longer referenced
+func releaseChunks(tx *bolt.Tx, ids []models.ChunkID) error {
+	chunks := tx.Bucket(chunksBucket)
+	for _, id := range ids {
+		v := chunks.Get(id[:])
+		if v == nil {
+			continue
+		}
+		refs := binary.BigEndian.Uint64(v)
+		if refs <= 1 {
+			if err := chunks.Delete(id[:]); err != nil {
+				return fmt.Errorf("error removing chunk: %w", err)
+			}
+			continue
+		}
+		v = append([]byte(nil), v...)
+		binary.BigEndian.PutUint64(v, refs-1)
+		if err := chunks.Put(id[:], v); err != nil {
+			return fmt.Errorf("error saving chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// getSignature reads the signature with the given ID
+func getSignature(tx *bolt.Tx, id uuid.UUID) (*models.Signature, error) {
+	v := tx.Bucket(signaturesBucket).Get(id[:])
+	if v == nil {
+		return nil, fmt.Errorf("signature not found")
+	}
+
+	signature := &models.Signature{}
+	if err := decode(v, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// putSignature writes the signature under its ID
+func putSignature(tx *bolt.Tx, signature *models.Signature) error {
+	if err := unindex(tx, signature.ID); err != nil {
+		return err
+	}
+
+	v, err := encode(signature)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(signaturesBucket).Put(signature.ID[:], v); err != nil {
+		return err
+	}
+
+	index := tx.Bucket(indexBucket)
+	for i := range signature.Chunks {
+		if err := index.Put(indexKey(signature, i), nil); err != nil {
+			return fmt.Errorf("error indexing chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// unindex removes the chunks of the signature with the given ID from the index, if it exists
+func unindex(tx *bolt.Tx, id uuid.UUID) error {
+	signature, err := getSignature(tx, id)
+	if err != nil {
+		return nil
+	}
+
+	index := tx.Bucket(indexBucket)
+	for i := range signature.Chunks {
+		if err := index.Delete(indexKey(signature, i)); err != nil {
+			return fmt.Errorf("error removing chunk from index: %w", err)
+		}
+	}
+	return nil
+}
+
+// chunkPrefix returns the part of the index keys identifying the content of a chunk: the length
+// of the strong digest, the digest, the weak checksum and the length of the chunk
+func chunkPrefix(c *models.Chunk) []byte {
+	key := make([]byte, 0, 1+len(c.Strong)+4+8+16+4)
+	key = append(key, byte(len(c.Strong)))
+	key = append(key, c.Strong...)
+	key = binary.BigEndian.AppendUint32(key, c.Weak)
+	return binary.BigEndian.AppendUint64(key, uint64(c.Length))
+}
+
+// indexKey returns the index key of chunk i of the signature: the chunk prefix followed by the
+// ID of the signature and the position of the chunk
+func indexKey(signature *models.Signature, i int) []byte {
+	key := append(chunkPrefix(&signature.Chunks[i]), signature.ID[:]...)
+	return binary.BigEndian.AppendUint32(key, uint32(i))
+}
+
+// appendVersion numbers the version after the latest one of the file and records it. The
+// snapshot of a version is stored on its own, see SaveSnapshot.
+func appendVersion(tx *bolt.Tx, filename string, version *models.Version) error {
+	versions, err := tx.Bucket(versionsBucket).CreateBucketIfNotExists([]byte(filename))
+	if err != nil {
+		return fmt.Errorf("error creating versions bucket: %w", err)
+	}
+
+	version.Number = 1
+	if k, _ := versions.Cursor().Last(); k != nil {
+		version.Number = int(binary.BigEndian.Uint64(k)) + 1
+	}
+	version.FilePath = filename
+	version.CreatedAt = time.Now()
+
+	record := *version
+	record.Snapshot = nil
+	record.SnapshotChunks = nil
+	record.Content = nil
+	v, err := encode(&record)
+	if err != nil {
+		return err
+	}
+	if err := versions.Put(versionKey(version.Number), v); err != nil {
+		return err
+	}
+
+	content := version.SnapshotReader()
+	if content == nil {
+		return nil
+	}
+	return putSnapshot(tx, filename, versionKey(version.Number), content)
+}
+
+// getVersion reads the version with the given key and its snapshot
+func getVersion(tx *bolt.Tx, filename string, key []byte) (*models.Version, error) {
+	var v []byte
+	if versions := tx.Bucket(versionsBucket).Bucket([]byte(filename)); versions != nil {
+		v = versions.Get(key)
+	}
+	if v == nil {
+		return nil, fmt.Errorf("version not found")
+	}
+
+	version := &models.Version{}
+	if err := decode(v, version); err != nil {
+		return nil, err
+	}
+	snapshots := tx.Bucket(snapshotsBucket).Bucket([]byte(filename))
+	if snapshots == nil {
+		return version, nil
+	}
+
+	ids, err := chunkstore.DecodeIDs(snapshots.Get(key))
+	if err != nil || ids == nil {
+		return version, err
+	}
+	chunks := tx.Bucket(chunksBucket)
+	version.SnapshotChunks = ids
+	// Join copies the data, values are only valid during the transaction
+	version.Snapshot, err = chunkstore.Join(ids, func(id models.ChunkID) ([]byte, error) {
+		v := chunks.Get(id[:])
+		if v == nil {
+			return nil, fmt.Errorf("chunk %s not found", id)
+		}
+		return v[8:], nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	return version, nil
+}
+
+// versionKey returns the key of version n, keys sort in version order
+func versionKey(n int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(n))
+	return key
+}
+
+// encode serializes a record with gob
+func encode(record interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return nil, fmt.Errorf("error encoding record: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decode deserializes a record encoded by encode
+func decode(data []byte, record interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(record); err != nil {
+		return fmt.Errorf("error decoding record: %w", err)
+	}
+	return nil
+}
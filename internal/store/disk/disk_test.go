@@ -0,0 +1,66 @@
+package disk
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store"
+	"github.com/hungaikev/rdiff/internal/store/storetest"
+)
+
+func TestStorage(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		log := zerolog.Nop()
+		s, err := Open(filepath.Join(t.TempDir(), "rdiff.db"), &log, otel.Tracer("tests"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "rdiff.db")
+
+	s, err := Open(path, &log, otel.Tracer("tests"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	saved, err := s.Save(ctx, &models.Version{Signature: &models.Signature{FilePath: "a.txt", FileSize: 8, Chunks: []models.Chunk{{Weak: 1, Strong: []byte("chunk 1"), Length: 8}}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "a.txt", 1, strings.NewReader("chunk 1 ")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// everything survives the process
+	s, err = Open(path, &log, otel.Tracer("tests"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	sig, err := s.GetSignatureForFilename(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sig.ID != saved.Signature.ID || sig.FileSize != 8 || len(sig.Chunks) != 1 {
+		t.Errorf("unexpected signature after reopening: %+v", sig)
+	}
+	if v, err := s.GetVersion(ctx, "a.txt", 1); err != nil || string(v.Snapshot) != "chunk 1 " {
+		t.Errorf("unexpected version after reopening: %+v, %v", v, err)
+	}
+}
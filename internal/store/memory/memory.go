@@ -2,9 +2,10 @@
 package memory
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,11 +15,33 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/chunkstore"
 )
 
+// chunkKey identifies the content of a chunk
+type chunkKey struct {
+	weak   uint32
+	length int64
+	strong string
+}
+
+// keyOf returns the key of the given chunk
+func keyOf(c *models.Chunk) chunkKey {
+	return chunkKey{weak: c.Weak, length: c.Length, strong: string(c.Strong)}
+}
+
+// chunkRef locates a chunk in a signature
+type chunkRef struct {
+	signature uuid.UUID
+	position  int
+}
+
 // Storage is the memory storage implementation
 type Storage struct {
 	signatures map[uuid.UUID]*models.Signature
+	versions   map[string][]*models.Version // versions by file path, oldest first
+	chunks     *chunkstore.Store            // content of the snapshots
+	index      map[chunkKey][]chunkRef      // chunks of the current signatures by hash
 	mu         sync.Mutex
 	log        *zerolog.Logger
 	tracer     trace.Tracer
@@ -26,31 +49,40 @@ type Storage struct {
 
 // New creates a new memory storage
 func New(log *zerolog.Logger, tracer trace.Tracer) *Storage {
-	var mutex sync.Mutex
 	tracer = otel.Tracer("memory")
 
 	return &Storage{
 		signatures: make(map[uuid.UUID]*models.Signature),
-		mu:         mutex,
+		versions:   make(map[string][]*models.Version),
+		chunks:     chunkstore.New(),
+		index:      make(map[chunkKey][]chunkRef),
 		log:        log,
 		tracer:     tracer,
 	}
 }
 
-// Save saves the file signature
-func (s *Storage) Save(ctx context.Context, signature *models.Signature) (*models.Signature, error) {
+// Save saves the signature of the version and records the version as a new version of the file,
+// with its snapshot if any
+func (s *Storage) Save(ctx context.Context, version *models.Version) (*models.Version, error) {
 	ctx, span := s.tracer.Start(ctx, "memory.Save")
 	defer span.End()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
 	signature.ID = uuid.New()
 	signature.CreatedAt = time.Now()
 
-	s.signatures[signature.ID] = signature
+	if err := s.appendVersion(signature.FilePath, version); err != nil {
+		return nil, err
+	}
+	s.putSignature(signature)
 
-	return signature, nil
+	return version, nil
 }
 
 // Get returns the signature for the given id
@@ -68,55 +100,218 @@ func (s *Storage) Get(ctx context.Context, id uuid.UUID) (*models.Signature, err
 	return signature, nil
 }
 
-// Update updates the given signature
-func (s *Storage) Update(ctx context.Context, signature *models.Signature) (*models.Signature, error) {
+// Update records the given version of a file stored under the ID of its signature
+func (s *Storage) Update(ctx context.Context, version *models.Version) (*models.Version, error) {
 	ctx, span := s.tracer.Start(ctx, "memory.Update")
 	defer span.End()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
+	current, ok := s.signatures[signature.ID]
+	if !ok {
+		return nil, fmt.Errorf("signature not found")
+	}
+
 	signature.LastModified = time.Now()
 
-	s.signatures[signature.ID] = signature
+	if err := s.appendVersion(current.FilePath, version); err != nil {
+		return nil, err
+	}
+	s.putSignature(signature)
 
-	return signature, nil
+	return version, nil
 }
 
-// ChunkExists checks if a chunk exists
-func (s *Storage) ChunkExists(ctx context.Context, chunk models.Chunk) (bool, error) {
-	ctx, span := s.tracer.Start(context.Background(), "memory.ChunkExists")
+// Delete removes the signature with the given ID and the versions of its file
+func (s *Storage) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, span := s.tracer.Start(ctx, "memory.Delete")
 	defer span.End()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, sig := range s.signatures {
-		for _, c := range sig.Chunks {
-			if bytes.Equal(c.Data, chunk.Data) {
-				return true, nil
+	signature, ok := s.signatures[id]
+	if !ok {
+		return fmt.Errorf("signature not found")
+	}
+	s.deleteFile(signature.FilePath)
+	return nil
+}
+
+// DeleteByFilename removes the versions of the given file and their signatures
+func (s *Storage) DeleteByFilename(ctx context.Context, filename string) error {
+	ctx, span := s.tracer.Start(ctx, "memory.DeleteByFilename")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.versions[filename]) == 0 {
+		return fmt.Errorf("file not found")
+	}
+	s.deleteFile(filename)
+	return nil
+}
+
+// deleteFile removes the versions of the file, releasing their snapshots, and the signatures
+// they were recorded under
+func (s *Storage) deleteFile(filename string) {
+	for _, v := range s.versions[filename] {
+		s.chunks.Release(v.SnapshotChunks)
+		if signature, ok := s.signatures[v.Signature.ID]; ok {
+			s.unindex(signature)
+			delete(s.signatures, signature.ID)
+		}
+	}
+	delete(s.versions, filename)
+}
+
+// List returns the current signatures of the files selected by the filter, a page at a time
+func (s *Storage) List(ctx context.Context, filter models.ListFilter, pageToken string, limit int) ([]*models.Signature, string, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.List")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	after, err := filter.After(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []*models.Signature
+	for _, history := range s.versions {
+		signature := history[len(history)-1].Signature
+		if filter.Match(signature) && (after == nil || filter.Less(after, signature)) {
+			files = append(files, signature)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filter.Less(files[i], files[j])
+	})
+
+	if len(files) <= limit {
+		return files, "", nil
+	}
+	return files[:limit], filter.PageToken(files[limit-1]), nil
+}
+
+// putSignature stores the signature and indexes its chunks, replacing the signature with the same ID
+func (s *Storage) putSignature(signature *models.Signature) {
+	if previous, ok := s.signatures[signature.ID]; ok {
+		s.unindex(previous)
+	}
+
+	s.signatures[signature.ID] = signature
+	for i := range signature.Chunks {
+		key := keyOf(&signature.Chunks[i])
+		s.index[key] = append(s.index[key], chunkRef{signature: signature.ID, position: i})
+	}
+}
+
+// unindex removes the chunks of the signature from the index
+func (s *Storage) unindex(signature *models.Signature) {
+	for i := range signature.Chunks {
+		key := keyOf(&signature.Chunks[i])
+		refs := s.index[key][:0]
+		for _, ref := range s.index[key] {
+			if ref.signature != signature.ID {
+				refs = append(refs, ref)
 			}
 		}
+		if len(refs) == 0 {
+			delete(s.index, key)
+			continue
+		}
+		s.index[key] = refs
 	}
-	return false, nil
 }
 
-// GetSignatureForChunk returns the signature that contains the given chunk
-func (s *Storage) GetSignatureForChunk(ctx context.Context, chunk models.Chunk) (*models.Signature, error) {
+// appendVersion numbers the version after the latest one of the file and records it. A
+// snapshot is kept in the chunk store.
+func (s *Storage) appendVersion(filename string, version *models.Version) error {
+	history := s.versions[filename]
+
+	version.Number = 1
+	if len(history) > 0 {
+		version.Number = history[len(history)-1].Number + 1
+	}
+	version.FilePath = filename
+	version.CreatedAt = time.Now()
+
+	record := *version
+	record.Content = nil
+	if content := version.SnapshotReader(); content != nil {
+		ids, err := s.chunks.PutReader(content)
+		if err != nil {
+			return fmt.Errorf("error saving snapshot: %w", err)
+		}
+		version.SnapshotChunks = ids
+		record.SnapshotChunks = ids
+		record.Snapshot = nil
+	}
+
+	s.versions[filename] = append(history, &record)
+	return nil
+}
+
+// load returns a copy of the version with the content of its snapshot
+func (s *Storage) load(version *models.Version) (*models.Version, error) {
+	loaded := *version
+	if version.SnapshotChunks != nil {
+		data, err := s.chunks.Get(version.SnapshotChunks)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot of version %d: %w", version.Number, err)
+		}
+		loaded.Snapshot = data
+	}
+	return &loaded, nil
+}
+
+// ChunkExists checks if a chunk exists
+func (s *Storage) ChunkExists(ctx context.Context, chunk models.Chunk) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.ChunkExists")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.index[keyOf(&chunk)]) > 0, nil
+}
+
+// GetSignatureForChunk returns the signatures that contain the given chunk, in the order
+// they were last saved or updated
+func (s *Storage) GetSignatureForChunk(ctx context.Context, chunk models.Chunk) ([]*models.Signature, error) {
 	ctx, span := s.tracer.Start(ctx, "memory.GetSignatureForChunk")
 	defer span.End()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, sig := range s.signatures {
-		for _, c := range sig.Chunks {
-			if bytes.Equal(c.Data, chunk.Data) {
-				return sig, nil
-			}
+	refs := s.index[keyOf(&chunk)]
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("signature not found")
+	}
+
+	signatures := make([]*models.Signature, 0, len(refs))
+	seen := make(map[uuid.UUID]bool, len(refs))
+	for _, ref := range refs {
+		// a signature holding the chunk several times is returned once
+		if seen[ref.signature] {
+			continue
 		}
+		seen[ref.signature] = true
+		signatures = append(signatures, s.signatures[ref.signature])
 	}
-	return nil, fmt.Errorf("signature not found")
+	return signatures, nil
 }
 
 // FileExists checks if a file exists
@@ -127,15 +322,10 @@ func (s *Storage) FileExists(ctx context.Context, filename string) (bool, error)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, sig := range s.signatures {
-		if sig.FilePath == filename {
-			return true, nil
-		}
-	}
-	return false, nil
+	return len(s.versions[filename]) > 0, nil
 }
 
-// GetSignatureForFilename returns the signature for the given file
+// GetSignatureForFilename returns the signature of the latest version of the given file
 func (s *Storage) GetSignatureForFilename(ctx context.Context, filename string) (*models.Signature, error) {
 	ctx, span := s.tracer.Start(ctx, "memory.GetSignatureForFilename")
 	defer span.End()
@@ -143,10 +333,167 @@ func (s *Storage) GetSignatureForFilename(ctx context.Context, filename string)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, sig := range s.signatures {
-		if sig.FilePath == filename {
-			return sig, nil
+	history := s.versions[filename]
+	if len(history) == 0 {
+		return nil, fmt.Errorf("signature not found")
+	}
+	return history[len(history)-1].Signature, nil
+}
+
+// ListVersions returns the versions of the given file, oldest first, without snapshot content
+func (s *Storage) ListVersions(ctx context.Context, filename string) ([]*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.ListVersions")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.versions[filename]
+	if len(history) == 0 {
+		return nil, fmt.Errorf("file not found")
+	}
+
+	versions := make([]*models.Version, 0, len(history))
+	for _, v := range history {
+		record := *v
+		versions = append(versions, &record)
+	}
+	return versions, nil
+}
+
+// LatestVersion returns the number of the latest version of the given file
+func (s *Storage) LatestVersion(ctx context.Context, filename string) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.LatestVersion")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.versions[filename]
+	if len(history) == 0 {
+		return 0, fmt.Errorf("file not found")
+	}
+	return history[len(history)-1].Number, nil
+}
+
+// GetVersion returns version n of the given file
+func (s *Storage) GetVersion(ctx context.Context, filename string, n int) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.GetVersion")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := s.find(filename, n)
+	if version == nil {
+		return nil, fmt.Errorf("version not found")
+	}
+	return s.load(version)
+}
+
+// find returns the record of version n of the given file, nil if there is none
+func (s *Storage) find(filename string, n int) *models.Version {
+	for _, v := range s.versions[filename] {
+		if v.Number == n {
+			return v
 		}
 	}
-	return nil, fmt.Errorf("signature not found")
+	return nil
+}
+
+// SaveSnapshot records the full content of version n of the given file
+func (s *Storage) SaveSnapshot(ctx context.Context, filename string, n int, content io.Reader) error {
+	ctx, span := s.tracer.Start(ctx, "memory.SaveSnapshot")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := s.find(filename, n)
+	if version == nil {
+		return fmt.Errorf("version not found")
+	}
+
+	ids, err := s.chunks.PutReader(content)
+	if err != nil {
+		return fmt.Errorf("error saving snapshot: %w", err)
+	}
+	// a snapshot replaced by another one releases its chunks
+	s.chunks.Release(version.SnapshotChunks)
+	version.SnapshotChunks = ids
+	return nil
+}
+
+// ChunkStats describes the content of the snapshots held by the storage
+func (s *Storage) ChunkStats(ctx context.Context) (*models.ChunkStats, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.ChunkStats")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.chunks.Stats()
+	return &stats, nil
+}
+
+// TagVersion adds a tag to version n of the given file
+func (s *Storage) TagVersion(ctx context.Context, filename string, n int, tag string) error {
+	ctx, span := s.tracer.Start(ctx, "memory.TagVersion")
+	defer span.End()
+
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := s.find(filename, n)
+	if version == nil {
+		return fmt.Errorf("version not found")
+	}
+	for _, t := range version.Tags {
+		if t == tag {
+			return nil
+		}
+	}
+	// the tags of the versions returned before are not modified
+	version.Tags = append(version.Tags[:len(version.Tags):len(version.Tags)], tag)
+	return nil
+}
+
+// GC removes the versions the policy does not retain and the chunks no longer referenced
+func (s *Storage) GC(ctx context.Context, policy models.RetentionPolicy, dryRun bool) (*models.GCReport, error) {
+	ctx, span := s.tracer.Start(ctx, "memory.GC")
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &models.GCReport{DryRun: dryRun}
+	marks := chunkstore.Marks{}
+	for filename, history := range s.versions {
+		report.Files++
+		keep := policy.Retain(history)
+
+		kept := make([]*models.Version, 0, len(keep))
+		for _, v := range history {
+			if keep[v.Number] {
+				marks.Add(v.SnapshotChunks)
+				kept = append(kept, v)
+				continue
+			}
+			report.Versions++
+			report.DeltaBytes += v.Delta.LiteralBytes() + v.Reverse.LiteralBytes()
+		}
+		if !dryRun {
+			s.versions[filename] = kept
+		}
+	}
+
+	report.Chunks, report.ChunkBytes = s.chunks.Sweep(marks, dryRun)
+
+	s.log.Info().Msgf("garbage collection: %d versions and %d chunks removed, %d bytes reclaimed, dry run %t",
+		report.Versions, report.Chunks, report.Reclaimable(), dryRun)
+	return report, nil
 }
@@ -0,0 +1,18 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/store"
+	"github.com/hungaikev/rdiff/internal/store/storetest"
+)
+
+func TestStorage(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		log := zerolog.Nop()
+		return New(&log, otel.Tracer("tests"))
+	})
+}
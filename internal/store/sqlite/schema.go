@@ -0,0 +1,117 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations creates and upgrades the schema of the database. Migration i moves the schema
+// from version i to version i+1, the version of a database is kept in PRAGMA user_version.
+// Released migrations must never change, new ones are appended.
+var migrations = []string{
+	// 1: files, their current signature with its chunks, and their version history
+	`
+	CREATE TABLE files (
+		id           INTEGER PRIMARY KEY,
+		path         TEXT NOT NULL UNIQUE,
+		signature_id BLOB
+	);
+
+	CREATE TABLE signatures (
+		id            BLOB PRIMARY KEY,
+		file_id       INTEGER NOT NULL REFERENCES files (id),
+		file_size     INTEGER NOT NULL,
+		checksum      BLOB,
+		last_modified INTEGER NOT NULL,
+		created_at    INTEGER NOT NULL,
+		weak_hash     INTEGER NOT NULL,
+		strong_hash   INTEGER NOT NULL,
+		strong_len    INTEGER NOT NULL,
+		block_size    INTEGER NOT NULL,
+		chunking      INTEGER NOT NULL,
+		chunk_min     INTEGER NOT NULL,
+		chunk_avg     INTEGER NOT NULL,
+		chunk_max     INTEGER NOT NULL
+	);
+
+	CREATE INDEX signatures_file_id ON signatures (file_id);
+
+	CREATE TABLE chunks (
+		signature_id BLOB NOT NULL REFERENCES signatures (id) ON DELETE CASCADE,
+		position     INTEGER NOT NULL,
+		weak         INTEGER NOT NULL,
+		strong       BLOB NOT NULL,
+		file_offset  INTEGER NOT NULL,
+		length       INTEGER NOT NULL,
+		PRIMARY KEY (signature_id, position)
+	);
+
+	CREATE INDEX chunks_hash ON chunks (strong, weak, length);
+
+	CREATE TABLE versions (
+		file_id    INTEGER NOT NULL REFERENCES files (id),
+		number     INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		signature  BLOB NOT NULL,
+		delta      BLOB,
+		reverse    BLOB,
+		snapshot   BLOB,
+		PRIMARY KEY (file_id, number)
+	);
+	`,
+
+	// 2: content-addressed chunks of the snapshots, shared between versions and files. Snapshots
+	// saved before are still read from versions.snapshot.
+	`
+	CREATE TABLE content_chunks (
+		id   BLOB PRIMARY KEY,
+		refs INTEGER NOT NULL,
+		data BLOB NOT NULL
+	);
+
+	ALTER TABLE versions ADD COLUMN snapshot_chunks BLOB;
+	`,
+
+	// 3: tags of the versions, removed with their version
+	`
+	CREATE TABLE version_tags (
+		file_id INTEGER NOT NULL,
+		number  INTEGER NOT NULL,
+		tag     TEXT NOT NULL,
+		PRIMARY KEY (file_id, number, tag),
+		FOREIGN KEY (file_id, number) REFERENCES versions (file_id, number) ON DELETE CASCADE
+	);
+	`,
+}
+
+// migrate applies the migrations the database has not seen yet, each one in its own transaction
+func migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this program, it knows up to %d", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error starting migration %d: %w", version+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d: %w", version+1, err)
+		}
+		// PRAGMA does not take parameters
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %d: %w", version+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
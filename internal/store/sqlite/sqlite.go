@@ -0,0 +1,927 @@
+// Package sqlite implements the storage interface on SQLite, with a pure Go driver
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/chunkstore"
+)
+
+// signatureColumns are the columns of the signatures table, in the order of scanSignature
+const signatureColumns = `s.id, f.path, s.file_size, s.checksum, s.last_modified, s.created_at, s.weak_hash, s.strong_hash,
+	s.strong_len, s.block_size, s.chunking, s.chunk_min, s.chunk_avg, s.chunk_max`
+
+// Storage is the SQLite storage implementation
+type Storage struct {
+	db     *sql.DB
+	log    *zerolog.Logger
+	tracer trace.Tracer
+}
+
+// querier runs queries, in a transaction or not
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Open opens the storage in the database file at path, creating it when it does not exist,
+// and migrates its schema to the latest version
+func Open(ctx context.Context, path string, log *zerolog.Logger, tracer trace.Tracer) (*Storage, error) {
+	tracer = otel.Tracer("sqlite")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+	// SQLite serializes writers, a single connection avoids busy errors between them
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Storage{
+		db:     db,
+		log:    log,
+		tracer: tracer,
+	}, nil
+}
+
+// Close closes the database
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Save saves the signature of the version and records the version as a new version of the file,
+// with its snapshot if any
+func (s *Storage) Save(ctx context.Context, version *models.Version) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.Save")
+	defer span.End()
+
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
+	signature.ID = uuid.New()
+	signature.CreatedAt = time.Now()
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO files (path) VALUES (?)
+			ON CONFLICT (path) DO UPDATE SET path = excluded.path
+			RETURNING id`, signature.FilePath).Scan(&fileID)
+		if err != nil {
+			return fmt.Errorf("error saving file: %w", err)
+		}
+
+		if err := putSignature(ctx, tx, fileID, signature); err != nil {
+			return err
+		}
+		return appendVersion(ctx, tx, fileID, signature.FilePath, version)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error saving signature: %w", err)
+	}
+	return version, nil
+}
+
+// Get returns the signature for the given id
+func (s *Storage) Get(ctx context.Context, id uuid.UUID) (*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.Get")
+	defer span.End()
+
+	return getSignature(ctx, s.db, id)
+}
+
+// Update records the given version of a file stored under the ID of its signature
+func (s *Storage) Update(ctx context.Context, version *models.Version) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.Update")
+	defer span.End()
+
+	signature := version.Signature
+	if signature == nil {
+		return nil, fmt.Errorf("version has no signature")
+	}
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		var path string
+		err := tx.QueryRowContext(ctx, `
+			SELECT f.id, f.path FROM signatures s JOIN files f ON f.id = s.file_id
+			WHERE s.id = ?`, signature.ID[:]).Scan(&fileID, &path)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("signature not found")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading signature: %w", err)
+		}
+
+		signature.LastModified = time.Now()
+		if err := putSignature(ctx, tx, fileID, signature); err != nil {
+			return err
+		}
+		return appendVersion(ctx, tx, fileID, path, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// ChunkExists checks if a chunk exists
+func (s *Storage) ChunkExists(ctx context.Context, chunk models.Chunk) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.ChunkExists")
+	defer span.End()
+
+	ids, err := findChunk(ctx, s.db, chunk)
+	if err != nil {
+		return false, fmt.Errorf("error looking up chunk: %w", err)
+	}
+	return len(ids) > 0, nil
+}
+
+// GetSignatureForChunk returns the signatures that contain the given chunk
+func (s *Storage) GetSignatureForChunk(ctx context.Context, chunk models.Chunk) ([]*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.GetSignatureForChunk")
+	defer span.End()
+
+	ids, err := findChunk(ctx, s.db, chunk)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up chunk: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("signature not found")
+	}
+
+	signatures := make([]*models.Signature, 0, len(ids))
+	for _, id := range ids {
+		signature, err := getSignature(ctx, s.db, id)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, nil
+}
+
+// FileExists checks if a file exists
+func (s *Storage) FileExists(ctx context.Context, filename string) (bool, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.FileExists")
+	defer span.End()
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM files WHERE path = ?)`, filename).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error looking up file: %w", err)
+	}
+	return exists, nil
+}
+
+// GetSignatureForFilename returns the signature of the latest version of the given file
+func (s *Storage) GetSignatureForFilename(ctx context.Context, filename string) (*models.Signature, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.GetSignatureForFilename")
+	defer span.End()
+
+	var id []byte
+	err := s.db.QueryRowContext(ctx, `SELECT signature_id FROM files WHERE path = ?`, filename).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("signature not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up file: %w", err)
+	}
+
+	signatureID, err := uuid.FromBytes(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature ID: %w", err)
+	}
+	return getSignature(ctx, s.db, signatureID)
+}
+
+// ListVersions returns the versions of the given file, oldest first, without snapshot content
+func (s *Storage) ListVersions(ctx context.Context, filename string) ([]*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.ListVersions")
+	defer span.End()
+
+	history, err := queryRecords(ctx, s.db, `WHERE f.path = ? ORDER BY v.number`, filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("file not found")
+	}
+	return history, nil
+}
+
+// LatestVersion returns the number of the latest version of the given file
+func (s *Storage) LatestVersion(ctx context.Context, filename string) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.LatestVersion")
+	defer span.End()
+
+	var n sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT MAX(v.number) FROM versions v JOIN files f ON f.id = v.file_id
+		WHERE f.path = ?`, filename).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("error reading versions: %w", err)
+	}
+	if !n.Valid {
+		return 0, fmt.Errorf("file not found")
+	}
+	return int(n.Int64), nil
+}
+
+// GetVersion returns version n of the given file
+func (s *Storage) GetVersion(ctx context.Context, filename string, n int) (*models.Version, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.GetVersion")
+	defer span.End()
+
+	history, err := queryVersions(ctx, s.db, `WHERE f.path = ? AND v.number = ?`, filename, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("version not found")
+	}
+	return history[0], nil
+}
+
+// SaveSnapshot records the full content of version n of the given file
+func (s *Storage) SaveSnapshot(ctx context.Context, filename string, n int, content io.Reader) error {
+	ctx, span := s.tracer.Start(ctx, "sqlite.SaveSnapshot")
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT v.file_id FROM versions v JOIN files f ON f.id = v.file_id
+			WHERE f.path = ? AND v.number = ?`, filename, n).Scan(&fileID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("version not found")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading version: %w", err)
+		}
+		return putSnapshot(ctx, tx, fileID, n, content)
+	})
+}
+
+// ChunkStats describes the content of the snapshots held by the storage
+func (s *Storage) ChunkStats(ctx context.Context) (*models.ChunkStats, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.ChunkStats")
+	defer span.End()
+
+	stats := &models.ChunkStats{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0), COALESCE(SUM(refs), 0), COALESCE(SUM(refs * LENGTH(data)), 0)
+		FROM content_chunks`).Scan(&stats.Chunks, &stats.Bytes, &stats.References, &stats.LogicalBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunks: %w", err)
+	}
+	return stats, nil
+}
+
+// TagVersion adds a tag to version n of the given file
+func (s *Storage) TagVersion(ctx context.Context, filename string, n int, tag string) error {
+	ctx, span := s.tracer.Start(ctx, "sqlite.TagVersion")
+	defer span.End()
+
+	if tag == "" {
+		return fmt.Errorf("empty tag")
+	}
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT v.file_id FROM versions v JOIN files f ON f.id = v.file_id
+			WHERE f.path = ? AND v.number = ?`, filename, n).Scan(&fileID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("version not found")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading version: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO version_tags (file_id, number, tag) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING`, fileID, n, tag)
+		if err != nil {
+			return fmt.Errorf("error saving tag: %w", err)
+		}
+		return nil
+	})
+}
+
+// GC removes the versions the policy does not retain and the chunks no longer referenced
+func (s *Storage) GC(ctx context.Context, policy models.RetentionPolicy, dryRun bool) (*models.GCReport, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.GC")
+	defer span.End()
+
+	report := &models.GCReport{DryRun: dryRun}
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		files, err := queryFiles(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		marks := chunkstore.Marks{}
+		for fileID, path := range files {
+			report.Files++
+			history, err := queryRecords(ctx, tx, `WHERE v.file_id = ? ORDER BY v.number`, fileID)
+			if err != nil {
+				return err
+			}
+
+			keep := policy.Retain(history)
+			for _, v := range history {
+				if keep[v.Number] {
+					marks.Add(v.SnapshotChunks)
+					continue
+				}
+				report.Versions++
+				report.DeltaBytes += v.Delta.LiteralBytes() + v.Reverse.LiteralBytes()
+				if dryRun {
+					continue
+				}
+				// the tags are removed with the version, see ON DELETE CASCADE
+				if _, err := tx.ExecContext(ctx, `DELETE FROM versions WHERE file_id = ? AND number = ?`, fileID, v.Number); err != nil {
+					return fmt.Errorf("error removing version %d of %s: %w", v.Number, path, err)
+				}
+			}
+		}
+
+		report.Chunks, report.ChunkBytes, err = sweepChunks(ctx, tx, marks, dryRun)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error collecting garbage: %w", err)
+	}
+
+	s.log.Info().Msgf("garbage collection: %d versions and %d chunks removed, %d bytes reclaimed, dry run %t",
+		report.Versions, report.Chunks, report.Reclaimable(), dryRun)
+	return report, nil
+}
+
+// Delete removes the signature with the given ID and the versions of its file
+func (s *Storage) Delete(ctx context.Context, id uuid.UUID) error {
+	ctx, span := s.tracer.Start(ctx, "sqlite.Delete")
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		err := tx.QueryRowContext(ctx, `SELECT file_id FROM signatures WHERE id = ?`, id[:]).Scan(&fileID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("signature not found")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading signature: %w", err)
+		}
+		return deleteFile(ctx, tx, fileID)
+	})
+}
+
+// DeleteByFilename removes the versions of the given file and their signatures
+func (s *Storage) DeleteByFilename(ctx context.Context, filename string) error {
+	ctx, span := s.tracer.Start(ctx, "sqlite.DeleteByFilename")
+	defer span.End()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var fileID int64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM files WHERE path = ?`, filename).Scan(&fileID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("file not found")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		return deleteFile(ctx, tx, fileID)
+	})
+}
+
+// List returns the current signatures of the files selected by the filter, a page at a time
+func (s *Storage) List(ctx context.Context, filter models.ListFilter, pageToken string, limit int) ([]*models.Signature, string, error) {
+	ctx, span := s.tracer.Start(ctx, "sqlite.List")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	after, err := filter.After(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// substr and length count characters, the range on path lets the prefix use the index
+	query := `
+		SELECT s.id FROM files f JOIN signatures s ON s.id = f.signature_id
+		WHERE f.path >= ?1 AND substr(f.path, 1, length(?1)) = ?1`
+	order := ` ORDER BY f.path`
+	args := []interface{}{filter.Prefix}
+	switch {
+	case filter.OrderBy == models.OrderByModified:
+		modified := `MAX(s.last_modified, s.created_at)`
+		order = ` ORDER BY ` + modified + ` DESC, f.path`
+		if after != nil {
+			query += ` AND (` + modified + ` < ?2 OR (` + modified + ` = ?2 AND f.path > ?3))`
+			args = append(args, unixNano(after.ModifiedAt()), after.FilePath)
+		}
+	case after != nil:
+		query += ` AND f.path > ?2`
+		args = append(args, after.FilePath)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query+order+fmt.Sprintf(" LIMIT %d", limit+1), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing files: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, "", fmt.Errorf("error listing files: %w", err)
+		}
+		id, err := uuid.FromBytes(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid signature ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error listing files: %w", err)
+	}
+	rows.Close()
+
+	files := make([]*models.Signature, 0, len(ids))
+	for _, id := range ids {
+		signature, err := getSignature(ctx, s.db, id)
+		if err != nil {
+			return nil, "", err
+		}
+		files = append(files, signature)
+	}
+
+	if len(files) <= limit {
+		return files, "", nil
+	}
+	return files[:limit], filter.PageToken(files[limit-1]), nil
+}
+
+// deleteFile removes the versions of the file, releasing the chunks of their snapshots, its
+// signatures and the file
+func deleteFile(ctx context.Context, tx *sql.Tx, fileID int64) error {
+	history, err := queryRecords(ctx, tx, `WHERE v.file_id = ?`, fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range history {
+		if err := releaseChunks(ctx, tx, v.SnapshotChunks); err != nil {
+			return err
+		}
+	}
+
+	// tags are removed with the versions and chunks with the signatures, see ON DELETE CASCADE
+	for _, statement := range []string{
+		`DELETE FROM versions WHERE file_id = ?`,
+		`DELETE FROM signatures WHERE file_id = ?`,
+		`DELETE FROM files WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, statement, fileID); err != nil {
+			return fmt.Errorf("error removing file: %w", err)
+		}
+	}
+	return nil
+}
+
+// queryFiles returns the paths of the files by ID
+func queryFiles(ctx context.Context, q querier) (map[int64]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id, path FROM files`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading files: %w", err)
+	}
+	defer rows.Close()
+
+	files := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+		files[id] = path
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading files: %w", err)
+	}
+	return files, nil
+}
+
+// sweepChunks sets the reference count of every chunk to its number of marks and removes the
+// chunks without any, see chunkstore.Store.Sweep
+func sweepChunks(ctx context.Context, tx *sql.Tx, marks chunkstore.Marks, dryRun bool) (chunks, size int64, err error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, refs, LENGTH(data) FROM content_chunks`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var removed, updated []models.ChunkID
+	for rows.Next() {
+		var b []byte
+		var refs, length int64
+		if err := rows.Scan(&b, &refs, &length); err != nil {
+			return 0, 0, fmt.Errorf("error reading chunk: %w", err)
+		}
+		var id models.ChunkID
+		copy(id[:], b)
+		if marks[id] == 0 {
+			chunks++
+			size += length
+			removed = append(removed, id)
+			continue
+		}
+		if refs != marks[id] {
+			updated = append(updated, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("error reading chunks: %w", err)
+	}
+	rows.Close()
+	if dryRun {
+		return chunks, size, nil
+	}
+
+	for _, id := range removed {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM content_chunks WHERE id = ?`, id[:]); err != nil {
+			return 0, 0, fmt.Errorf("error removing chunk: %w", err)
+		}
+	}
+	for _, id := range updated {
+		if _, err := tx.ExecContext(ctx, `UPDATE content_chunks SET refs = ? WHERE id = ?`, marks[id], id[:]); err != nil {
+			return 0, 0, fmt.Errorf("error updating chunk: %w", err)
+		}
+	}
+	return chunks, size, nil
+}
+
+// inTx runs f in a transaction, committed when f succeeds
+func (s *Storage) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
+}
+
+// putSignature writes the signature and its chunks, replacing the ones with the same ID, and
+// makes it the current signature of the file
+func putSignature(ctx context.Context, tx *sql.Tx, fileID int64, signature *models.Signature) error {
+	id := signature.ID[:]
+
+	// the chunks are removed with the old row, see ON DELETE CASCADE
+	if _, err := tx.ExecContext(ctx, `DELETE FROM signatures WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("error removing previous signature: %w", err)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO signatures (id, file_id, file_size, checksum, last_modified, created_at, weak_hash, strong_hash,
+			strong_len, block_size, chunking, chunk_min, chunk_avg, chunk_max)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, fileID, signature.FileSize, signature.Checksum, unixNano(signature.LastModified), unixNano(signature.CreatedAt),
+		signature.WeakHash, signature.StrongHash, signature.StrongLen, signature.BlockSize, signature.Chunking,
+		signature.ChunkSizes.Min, signature.ChunkSizes.Avg, signature.ChunkSizes.Max)
+	if err != nil {
+		return fmt.Errorf("error saving signature: %w", err)
+	}
+
+	insert, err := tx.PrepareContext(ctx, `
+		INSERT INTO chunks (signature_id, position, weak, strong, file_offset, length) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("error preparing chunks: %w", err)
+	}
+	defer insert.Close()
+
+	for i, c := range signature.Chunks {
+		if _, err := insert.ExecContext(ctx, id, i, c.Weak, c.Strong, c.Offset, c.Length); err != nil {
+			return fmt.Errorf("error saving chunk %d: %w", i, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE files SET signature_id = ? WHERE id = ?`, id, fileID); err != nil {
+		return fmt.Errorf("error updating file: %w", err)
+	}
+	return nil
+}
+
+// getSignature reads the signature with the given ID and its chunks
+func getSignature(ctx context.Context, q querier, id uuid.UUID) (*models.Signature, error) {
+	row := q.QueryRowContext(ctx, `SELECT `+signatureColumns+`
+		FROM signatures s JOIN files f ON f.id = s.file_id WHERE s.id = ?`, id[:])
+
+	signature, err := scanSignature(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("signature not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %w", err)
+	}
+
+	rows, err := q.QueryContext(ctx, `
+		SELECT weak, strong, file_offset, length FROM chunks WHERE signature_id = ? ORDER BY position`, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.Chunk
+		if err := rows.Scan(&c.Weak, &c.Strong, &c.Offset, &c.Length); err != nil {
+			return nil, fmt.Errorf("error reading chunk: %w", err)
+		}
+		signature.Chunks = append(signature.Chunks, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading chunks: %w", err)
+	}
+	return signature, nil
+}
+
+// scanSignature reads the columns listed in signatureColumns
+func scanSignature(row *sql.Row) (*models.Signature, error) {
+	var signature models.Signature
+	var id []byte
+	var lastModified, createdAt int64
+
+	err := row.Scan(&id, &signature.FilePath, &signature.FileSize, &signature.Checksum, &lastModified, &createdAt,
+		&signature.WeakHash, &signature.StrongHash, &signature.StrongLen, &signature.BlockSize, &signature.Chunking,
+		&signature.ChunkSizes.Min, &signature.ChunkSizes.Avg, &signature.ChunkSizes.Max)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature.ID, err = uuid.FromBytes(id); err != nil {
+		return nil, fmt.Errorf("invalid signature ID: %w", err)
+	}
+	signature.LastModified = fromUnixNano(lastModified)
+	signature.CreatedAt = fromUnixNano(createdAt)
+	return &signature, nil
+}
+
+// findChunk returns the IDs of the signatures holding a chunk with the same content
+func findChunk(ctx context.Context, q querier, chunk models.Chunk) ([]uuid.UUID, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT DISTINCT signature_id FROM chunks WHERE strong = ? AND weak = ? AND length = ?`,
+		chunk.Strong, chunk.Weak, chunk.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		id, err := uuid.FromBytes(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// appendVersion numbers the version after the latest one of the file and records it
+func appendVersion(ctx context.Context, tx *sql.Tx, fileID int64, path string, version *models.Version) error {
+	var latest int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(number), 0) FROM versions WHERE file_id = ?`, fileID).Scan(&latest); err != nil {
+		return fmt.Errorf("error reading versions: %w", err)
+	}
+
+	version.Number = latest + 1
+	version.FilePath = path
+	version.CreatedAt = time.Now()
+
+	signature, err := encode(version.Signature)
+	if err != nil {
+		return err
+	}
+	delta, err := encode(version.Delta)
+	if err != nil {
+		return err
+	}
+	reverse, err := encode(version.Reverse)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO versions (file_id, number, created_at, signature, delta, reverse) VALUES (?, ?, ?, ?, ?, ?)`,
+		fileID, version.Number, unixNano(version.CreatedAt), signature, delta, reverse)
+	if err != nil {
+		return fmt.Errorf("error saving version: %w", err)
+	}
+
+	content := version.SnapshotReader()
+	if content == nil {
+		return nil
+	}
+	return putSnapshot(ctx, tx, fileID, version.Number, content)
+}
+
+// putSnapshot stores the content of a snapshot in the chunk store and records its chunks in the
+// version, releasing the chunks of a previous snapshot
+func putSnapshot(ctx context.Context, tx *sql.Tx, fileID int64, n int, content io.Reader) error {
+	ids := make([]models.ChunkID, 0)
+	err := chunkstore.SplitReader(content, func(part []byte) error {
+		id := models.NewChunkID(part)
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO content_chunks (id, refs, data) VALUES (?, 1, ?)
+			ON CONFLICT (id) DO UPDATE SET refs = refs + 1`, id[:], part)
+		if err != nil {
+			return fmt.Errorf("error saving chunk: %w", err)
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var encoded []byte
+	if err := tx.QueryRowContext(ctx, `SELECT snapshot_chunks FROM versions WHERE file_id = ? AND number = ?`, fileID, n).Scan(&encoded); err != nil {
+		return fmt.Errorf("error reading version: %w", err)
+	}
+	previous, err := chunkstore.DecodeIDs(encoded)
+	if err != nil {
+		return err
+	}
+	if err := releaseChunks(ctx, tx, previous); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE versions SET snapshot = NULL, snapshot_chunks = ? WHERE file_id = ? AND number = ?`,
+		chunkstore.EncodeIDs(ids), fileID, n)
+	if err != nil {
+		return fmt.Errorf("error saving snapshot: %w", err)
+	}
+	return nil
+}
+
+// releaseChunks drops a reference to each of the given chunks, removing the ones no longer referenced
+func releaseChunks(ctx context.Context, tx *sql.Tx, ids []models.ChunkID) error {
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `UPDATE content_chunks SET refs = refs - 1 WHERE id = ?`, id[:]); err != nil {
+			return fmt.Errorf("error releasing chunk: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM content_chunks WHERE id = ? AND refs <= 0`, id[:]); err != nil {
+			return fmt.Errorf("error removing chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// queryVersions reads the versions selected by the given clause
+func queryVersions(ctx context.Context, q querier, clause string, args ...interface{}) ([]*models.Version, error) {
+	history, err := queryRecords(ctx, q, clause, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, version := range history {
+		if version.SnapshotChunks == nil {
+			continue
+		}
+		version.Snapshot, err = chunkstore.Join(version.SnapshotChunks, func(id models.ChunkID) ([]byte, error) {
+			var data []byte
+			if err := q.QueryRowContext(ctx, `SELECT data FROM content_chunks WHERE id = ?`, id[:]).Scan(&data); err != nil {
+				return nil, fmt.Errorf("error reading chunk %s: %w", id, err)
+			}
+			return data, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot of version %d: %w", version.Number, err)
+		}
+	}
+	return history, nil
+}
+
+// queryRecords reads the versions selected by the given clause, with the chunks of their
+// snapshots but not their content. The rows are closed when it returns, so that the single
+// connection is free again.
+func queryRecords(ctx context.Context, q querier, clause string, args ...interface{}) ([]*models.Version, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT f.path, v.number, v.created_at, v.signature, v.delta, v.reverse, v.snapshot, v.snapshot_chunks,
+			(SELECT json_group_array(t.tag) FROM version_tags t WHERE t.file_id = v.file_id AND t.number = v.number)
+		FROM versions v JOIN files f ON f.id = v.file_id `+clause, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading versions: %w", err)
+	}
+	defer rows.Close()
+
+	var history []*models.Version
+	for rows.Next() {
+		version := &models.Version{}
+		var createdAt int64
+		var signature, delta, reverse, snapshotChunks []byte
+		var tags string
+		if err := rows.Scan(&version.FilePath, &version.Number, &createdAt, &signature, &delta, &reverse, &version.Snapshot, &snapshotChunks, &tags); err != nil {
+			return nil, fmt.Errorf("error reading version: %w", err)
+		}
+		version.CreatedAt = fromUnixNano(createdAt)
+		if version.SnapshotChunks, err = chunkstore.DecodeIDs(snapshotChunks); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &version.Tags); err != nil {
+			return nil, fmt.Errorf("error reading tags: %w", err)
+		}
+		if len(version.Tags) == 0 {
+			version.Tags = nil
+		}
+
+		if err := decode(signature, &version.Signature); err != nil {
+			return nil, err
+		}
+		if err := decode(delta, &version.Delta); err != nil {
+			return nil, err
+		}
+		if err := decode(reverse, &version.Reverse); err != nil {
+			return nil, err
+		}
+		history = append(history, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading versions: %w", err)
+	}
+	return history, nil
+}
+
+// unixNano returns t in nanoseconds since the epoch, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// encode serializes a record with gob, a nil record is stored as NULL
+func encode[T any](record *T) ([]byte, error) {
+	if record == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return nil, fmt.Errorf("error encoding record: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decode deserializes a record encoded by encode, NULL leaves the record nil
+func decode[T any](data []byte, record **T) error {
+	if data == nil {
+		return nil
+	}
+	*record = new(T)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(*record); err != nil {
+		return fmt.Errorf("error decoding record: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store"
+	"github.com/hungaikev/rdiff/internal/store/storetest"
+)
+
+func TestStorage(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Storage {
+		log := zerolog.Nop()
+		s, err := Open(context.Background(), filepath.Join(t.TempDir(), "rdiff.sqlite"), &log, otel.Tracer("tests"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "rdiff.sqlite")
+
+	s, err := Open(ctx, path, &log, otel.Tracer("tests"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	saved, err := s.Save(ctx, &models.Version{Signature: &models.Signature{FilePath: "a.txt", FileSize: 8, Chunks: []models.Chunk{{Weak: 1, Strong: []byte("chunk 1"), Length: 8}}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// migrations are not applied twice
+	s, err = Open(ctx, path, &log, otel.Tracer("tests"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	var version int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil || version != len(migrations) {
+		t.Errorf("unexpected schema version: %d, %v", version, err)
+	}
+
+	sig, err := s.GetSignatureForFilename(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sig.ID != saved.Signature.ID || sig.FileSize != 8 || len(sig.Chunks) != 1 {
+		t.Errorf("unexpected signature after reopening: %+v", sig)
+	}
+}
+
+func TestIndexedQueries(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+
+	s, err := Open(ctx, filepath.Join(t.TempDir(), "rdiff.sqlite"), &log, otel.Tracer("tests"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	queries := map[string]string{
+		"chunk lookup": `SELECT DISTINCT signature_id FROM chunks WHERE strong = x'00' AND weak = 1 AND length = 8`,
+		"file lookup":  `SELECT signature_id FROM files WHERE path = 'a.txt'`,
+		"file listing": `SELECT s.id FROM files f JOIN signatures s ON s.id = f.signature_id
+			WHERE f.path >= 'src/' AND substr(f.path, 1, length('src/')) = 'src/' AND f.path > 'src/a.go' ORDER BY f.path LIMIT 3`,
+	}
+	for name, query := range queries {
+		rows, err := s.db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		var plan string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			plan += detail + "\n"
+		}
+		rows.Close()
+
+		if !strings.Contains(plan, "USING INDEX") && !strings.Contains(plan, "USING COVERING INDEX") {
+			t.Errorf("%s does not use an index:\n%s", name, plan)
+		}
+	}
+}
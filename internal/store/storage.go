@@ -3,6 +3,7 @@ package store
 
 import (
 	"context"
+	"io"
 
 	"github.com/google/uuid"
 
@@ -10,24 +11,67 @@ import (
 )
 
 type Storage interface {
-	// Save saves the given signature to storage
-	Save(ctx context.Context, signature *models.Signature) (*models.Signature, error)
+	// Save stores the signature of the version as the signature of a new file and records the
+	// version as its first one. The snapshot of the version, if any, is stored with it, see
+	// models.Version.Content.
+	Save(ctx context.Context, version *models.Version) (*models.Version, error)
 
 	// Get retrieves the signature with the given ID from storage
 	Get(ctx context.Context, id uuid.UUID) (*models.Signature, error)
 
-	// Update updates the signature with the given ID in storage
-	Update(ctx context.Context, signature *models.Signature) (*models.Signature, error)
+	// Update records a new version of the file whose signature has the ID of the signature of
+	// the version. The version is numbered after the latest one and becomes the current
+	// signature of the file. The snapshot of the version, if any, is stored with it.
+	Update(ctx context.Context, version *models.Version) (*models.Version, error)
+
+	// Delete removes the signature with the given ID and the file it tracks: every version of the
+	// file, with its tags, and the snapshot content no other version references
+	Delete(ctx context.Context, id uuid.UUID) error
+
+	// DeleteByFilename removes the given file, see Delete
+	DeleteByFilename(ctx context.Context, filename string) error
+
+	// List returns the current signatures of up to limit files selected by the filter, in its
+	// order, starting after the given page token, "" for the first page. It also returns the
+	// token of the next page, "" after the last one.
+	List(ctx context.Context, filter models.ListFilter, pageToken string, limit int) ([]*models.Signature, string, error)
 
 	// ChunkExists checks if the given chunk exists in storage
 	ChunkExists(ctx context.Context, chunk models.Chunk) (bool, error)
 
-	// GetSignatureForChunk retrieves the signature that contains the given chunk
-	GetSignatureForChunk(ctx context.Context, chunk models.Chunk) (*models.Signature, error)
+	// GetSignatureForChunk retrieves every signature that contains the given chunk
+	GetSignatureForChunk(ctx context.Context, chunk models.Chunk) ([]*models.Signature, error)
 
 	// FileExists checks if the given file exists in storage
 	FileExists(ctx context.Context, filename string) (bool, error)
 
-	// GetSignatureForFilename retrieves the signature that contains the given file
+	// GetSignatureForFilename retrieves the signature of the latest version of the given file
 	GetSignatureForFilename(ctx context.Context, filename string) (*models.Signature, error)
+
+	// ListVersions retrieves the versions of the given file, oldest first. The content of the
+	// snapshots is not loaded, keyframes only carry their SnapshotChunks; use GetVersion to read it.
+	ListVersions(ctx context.Context, filename string) ([]*models.Version, error)
+
+	// LatestVersion returns the number of the latest version of the given file
+	LatestVersion(ctx context.Context, filename string) (int, error)
+
+	// GetVersion retrieves version n of the given file
+	GetVersion(ctx context.Context, filename string, n int) (*models.Version, error)
+
+	// SaveSnapshot records the full content of version n of the given file, restoring a version
+	// starts from the closest snapshot before it. The content is kept in a content-addressed
+	// chunk store, content shared between snapshots is stored once. The content is split into
+	// chunks as it is read.
+	SaveSnapshot(ctx context.Context, filename string, n int, content io.Reader) error
+
+	// ChunkStats describes the content held by the chunk store
+	ChunkStats(ctx context.Context) (*models.ChunkStats, error)
+
+	// TagVersion adds a tag to version n of the given file
+	TagVersion(ctx context.Context, filename string, n int, tag string) error
+
+	// GC removes the versions the policy does not retain, then the chunks no longer referenced
+	// by any snapshot, and sets the reference counts of the others to the references found.
+	// With dryRun nothing is removed and the report describes what would be.
+	GC(ctx context.Context, policy models.RetentionPolicy, dryRun bool) (*models.GCReport, error)
 }
@@ -0,0 +1,745 @@
+// Package storetest implements the contract tests every store.Storage implementation must pass.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store"
+)
+
+// Run runs the contract tests against the storage returned by newStorage. It is called once per
+// test and must return an empty storage.
+func Run(t *testing.T, newStorage func(t *testing.T) store.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s store.Storage)
+	}{
+		{"SaveGet", testSaveGet},
+		{"Files", testFiles},
+		{"Versions", testVersions},
+		{"Snapshots", testSnapshots},
+		{"Chunks", testChunks},
+		{"Content", testContent},
+		{"Tags", testTags},
+		{"GC", testGC},
+		{"Delete", testDelete},
+		{"List", testList},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// signature returns a signature of the given file with one chunk per digest
+func signature(path string, size int64, digests ...string) *models.Signature {
+	sig := &models.Signature{
+		FilePath:   path,
+		FileSize:   size,
+		Checksum:   []byte("checksum of " + path),
+		WeakHash:   models.WeakHashRabinKarp,
+		StrongHash: models.StrongHashBLAKE2b,
+		StrongLen:  32,
+		BlockSize:  8,
+	}
+	for i, d := range digests {
+		sig.Chunks = append(sig.Chunks, models.Chunk{Weak: uint32(len(d)), Strong: []byte(d), Offset: int64(8 * i), Length: 8})
+	}
+	return sig
+}
+
+// save stores the signature of a new file, see Storage.Save
+func save(ctx context.Context, s store.Storage, signature *models.Signature) (*models.Signature, error) {
+	version, err := s.Save(ctx, &models.Version{Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+	return version.Signature, nil
+}
+
+// same reports whether both signatures describe the same file. Storage may not return the
+// pointers it was given, nor preserve the monotonic clock readings of timestamps.
+func same(a, b *models.Signature) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.ID != b.ID || a.FilePath != b.FilePath || a.FileSize != b.FileSize || !bytes.Equal(a.Checksum, b.Checksum) ||
+		!a.CreatedAt.Equal(b.CreatedAt) || a.WeakHash != b.WeakHash || a.StrongHash != b.StrongHash || a.StrongLen != b.StrongLen ||
+		a.BlockSize != b.BlockSize || a.Chunking != b.Chunking || a.ChunkSizes != b.ChunkSizes || len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+	for i := range a.Chunks {
+		if !a.Chunks[i].ValidateChunk(&b.Chunks[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func testSaveGet(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	saved, err := save(ctx, s, signature("a.txt", 16, "chunk 1", "chunk 2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if saved.ID == uuid.Nil || saved.CreatedAt.IsZero() {
+		t.Errorf("saved signature has no ID or creation time: %v, %v", saved.ID, saved.CreatedAt)
+	}
+
+	got, err := s.Get(ctx, saved.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !same(got, saved) {
+		t.Errorf("unexpected signature: got %+v, want %+v", got, saved)
+	}
+
+	if _, err := s.Get(ctx, uuid.New()); err == nil {
+		t.Errorf("expected an error for an unknown ID")
+	}
+}
+
+func testFiles(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	if exists, err := s.FileExists(ctx, "a.txt"); err != nil || exists {
+		t.Errorf("unexpected result for a file not stored yet: %v, %v", exists, err)
+	}
+	if _, err := s.GetSignatureForFilename(ctx, "a.txt"); err == nil {
+		t.Errorf("expected an error for a file not stored yet")
+	}
+
+	a, err := save(ctx, s, signature("a.txt", 8, "chunk 1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := save(ctx, s, signature("b.txt", 8, "chunk 2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exists, err := s.FileExists(ctx, "a.txt"); err != nil || !exists {
+		t.Errorf("unexpected result for a stored file: %v, %v", exists, err)
+	}
+	got, err := s.GetSignatureForFilename(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !same(got, a) {
+		t.Errorf("unexpected signature: got %+v, want %+v", got, a)
+	}
+}
+
+func testVersions(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	first, err := save(ctx, s, signature("a.txt", 1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for size := int64(2); size <= 3; size++ {
+		sig := signature("a.txt", size)
+		sig.ID = first.ID
+		delta := &models.Delta{Ops: []models.Op{{Kind: models.OpLiteral, Length: 1, Data: []byte("x")}, {Kind: models.OpEnd}}, TargetLength: size}
+		version, err := s.Update(ctx, &models.Version{Signature: sig, Delta: delta, Reverse: &models.Delta{TargetLength: size - 1}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version.Number != int(size) || version.FilePath != "a.txt" || version.CreatedAt.IsZero() {
+			t.Errorf("unexpected version: %+v", version)
+		}
+	}
+
+	versions, err := s.ListVersions(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("unexpected number of versions: got %d, want 3", len(versions))
+	}
+	for i, v := range versions {
+		if v.Number != i+1 || v.FilePath != "a.txt" || v.Signature.FileSize != int64(i+1) {
+			t.Errorf("unexpected version %d: number %d, path %q, size %d", i+1, v.Number, v.FilePath, v.Signature.FileSize)
+		}
+		if i == 0 {
+			if v.Delta != nil || v.Reverse != nil {
+				t.Errorf("unexpected deltas of the first version: %v, %v", v.Delta, v.Reverse)
+			}
+			continue
+		}
+		if v.Delta == nil || v.Delta.TargetLength != int64(i+1) || len(v.Delta.Ops) != 2 || !bytes.Equal(v.Delta.Ops[0].Data, []byte("x")) {
+			t.Errorf("unexpected delta of version %d: %+v", i+1, v.Delta)
+		}
+		if v.Reverse == nil || v.Reverse.TargetLength != int64(i) {
+			t.Errorf("unexpected reverse delta of version %d: %+v", i+1, v.Reverse)
+		}
+	}
+
+	// the latest version is the current signature of the file
+	if sig, err := s.GetSignatureForFilename(ctx, "a.txt"); err != nil || sig.FileSize != 3 {
+		t.Errorf("unexpected signature: %v, %v", sig, err)
+	}
+	if sig, err := s.Get(ctx, first.ID); err != nil || sig.FileSize != 3 {
+		t.Errorf("unexpected signature: %v, %v", sig, err)
+	}
+
+	if v, err := s.GetVersion(ctx, "a.txt", 2); err != nil || v.Number != 2 || v.Signature.FileSize != 2 {
+		t.Errorf("unexpected version: %v, %v", v, err)
+	}
+	for _, n := range []int{0, 4} {
+		if _, err := s.GetVersion(ctx, "a.txt", n); err == nil {
+			t.Errorf("expected an error for version %d", n)
+		}
+	}
+	if _, err := s.ListVersions(ctx, "unknown.txt"); err == nil {
+		t.Errorf("expected an error for an unknown file")
+	}
+	if _, err := s.Update(ctx, &models.Version{Signature: signature("unknown.txt", 1)}); err == nil {
+		t.Errorf("expected an error for an unknown signature")
+	}
+}
+
+func testSnapshots(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	if _, err := save(ctx, s, signature("a.txt", 8)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "a.txt", 1, bytes.NewReader([]byte("content!"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	v, err := s.GetVersion(ctx, "a.txt", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(v.Snapshot, []byte("content!")) {
+		t.Errorf("unexpected snapshot: %q", v.Snapshot)
+	}
+
+	// the history marks the keyframe without reading its content
+	versions, err := s.ListVersions(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(versions) != 1 || !versions[0].IsKeyframe() || versions[0].Snapshot != nil {
+		t.Errorf("unexpected versions: %+v", versions)
+	}
+
+	// a snapshot is stored with the version that carries it
+	saved, err := s.Save(ctx, &models.Version{Signature: signature("b.txt", 8), Snapshot: []byte("first!")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated := signature("b.txt", 8)
+	updated.ID = saved.Signature.ID
+	if _, err := s.Update(ctx, &models.Version{Signature: updated, Delta: &models.Delta{}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the content of a snapshot can be read as it is stored
+	if _, err := s.Update(ctx, &models.Version{Signature: updated, Delta: &models.Delta{}, Content: bytes.NewReader([]byte("third!"))}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n, err := s.LatestVersion(ctx, "b.txt"); err != nil || n != 3 {
+		t.Errorf("unexpected latest version: %d, %v", n, err)
+	}
+	for n, want := range map[int][]byte{1: []byte("first!"), 2: nil, 3: []byte("third!")} {
+		v, err := s.GetVersion(ctx, "b.txt", n)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(v.Snapshot, want) || v.IsKeyframe() != (want != nil) {
+			t.Errorf("version %d: unexpected snapshot: %q", n, v.Snapshot)
+		}
+	}
+	if _, err := s.LatestVersion(ctx, "unknown.txt"); err == nil {
+		t.Errorf("expected an error for an unknown file")
+	}
+
+	if err := s.SaveSnapshot(ctx, "a.txt", 2, bytes.NewReader([]byte("content!"))); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+	if err := s.SaveSnapshot(ctx, "unknown.txt", 1, bytes.NewReader([]byte("content!"))); err == nil {
+		t.Errorf("expected an error for an unknown file")
+	}
+}
+
+func testChunks(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	a, err := save(ctx, s, signature("a.txt", 16, "chunk 1", "chunk 2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := save(ctx, s, signature("b.txt", 24, "chunk 2", "chunk 3", "chunk 2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the chunk is found at any offset
+	chunk := models.Chunk{Weak: uint32(len("chunk 2")), Strong: []byte("chunk 2"), Offset: 1024, Length: 8}
+	if exists, err := s.ChunkExists(ctx, chunk); err != nil || !exists {
+		t.Errorf("unexpected result for a stored chunk: %v, %v", exists, err)
+	}
+	got, err := s.GetSignatureForChunk(ctx, chunk)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !sameSet(got, a, b) {
+		t.Errorf("unexpected signatures: got %+v, want a.txt and b.txt", got)
+	}
+
+	// an updated signature replaces the chunks of the previous one
+	updated := signature("a.txt", 8, "chunk 4")
+	updated.ID = a.ID
+	if _, err := s.Update(ctx, &models.Version{Signature: updated}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, err := s.GetSignatureForChunk(ctx, chunk); err != nil || !sameSet(got, b) {
+		t.Errorf("unexpected signatures after an update: got %+v, %v, want b.txt", got, err)
+	}
+	if got, err := s.GetSignatureForChunk(ctx, updated.Chunks[0]); err != nil || !sameSet(got, updated) {
+		t.Errorf("unexpected signatures of a new chunk: got %+v, %v, want a.txt", got, err)
+	}
+
+	for _, unknown := range []models.Chunk{
+		{Weak: uint32(len("chunk 1")), Strong: []byte("chunk 1"), Length: 8},
+		{Weak: uint32(len("chunk 5")), Strong: []byte("chunk 5"), Length: 8},
+		// same digest, different length
+		{Weak: uint32(len("chunk 2")), Strong: []byte("chunk 2"), Length: 7},
+	} {
+		if exists, err := s.ChunkExists(ctx, unknown); err != nil || exists {
+			t.Errorf("unexpected result for an unknown chunk %q: %v, %v", unknown.Strong, exists, err)
+		}
+		if _, err := s.GetSignatureForChunk(ctx, unknown); err == nil {
+			t.Errorf("expected an error for an unknown chunk %q", unknown.Strong)
+		}
+	}
+}
+
+// sameSet reports whether got holds each of the wanted signatures once, in any order
+func sameSet(got []*models.Signature, want ...*models.Signature) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for _, w := range want {
+		n := 0
+		for _, g := range got {
+			if same(g, w) {
+				n++
+			}
+		}
+		if n != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+func testContent(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	a := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(a)
+	// b shares all of a but a few bytes at its start, at a different offset
+	b := append([]byte("a header of b"), a[100:]...)
+
+	for _, path := range []string{"a.txt", "b.txt", "empty.txt"} {
+		if _, err := save(ctx, s, signature(path, 0)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.SaveSnapshot(ctx, "a.txt", 1, bytes.NewReader(a)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "b.txt", 1, bytes.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "empty.txt", 1, bytes.NewReader([]byte{})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats, err := s.ChunkStats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.LogicalBytes != int64(len(a)+len(b)) {
+		t.Errorf("unexpected logical bytes: got %d, want %d", stats.LogicalBytes, len(a)+len(b))
+	}
+	// the content shared by both snapshots is stored once, only the chunks around the header differ
+	if max := int64(len(a)) + 2*65536; stats.Bytes > max {
+		t.Errorf("shared content is not deduplicated: %d bytes stored, want at most %d", stats.Bytes, max)
+	}
+
+	for path, want := range map[string][]byte{"a.txt": a, "b.txt": b, "empty.txt": {}} {
+		v, err := s.GetVersion(ctx, path, 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v.Snapshot == nil || !bytes.Equal(v.Snapshot, want) {
+			t.Errorf("unexpected snapshot of %s: %d bytes, want %d", path, len(v.Snapshot), len(want))
+		}
+	}
+
+	// replacing a snapshot releases the chunks only it referenced
+	if err := s.SaveSnapshot(ctx, "b.txt", 1, bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats, err = s.ChunkStats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.LogicalBytes != int64(len(a)+len("small")) || stats.Bytes != int64(len(a)+len("small")) {
+		t.Errorf("unexpected stats after replacing a snapshot: %+v", stats)
+	}
+	if v, err := s.GetVersion(ctx, "a.txt", 1); err != nil || !bytes.Equal(v.Snapshot, a) {
+		t.Errorf("snapshot of a.txt was modified: %v", err)
+	}
+}
+
+func testTags(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	if _, err := save(ctx, s, signature("a.txt", 8)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tag := range []string{"release", "beta", "release"} {
+		if err := s.TagVersion(ctx, "a.txt", 1, tag); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	v, err := s.GetVersion(ctx, "a.txt", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tags := append([]string(nil), v.Tags...)
+	sort.Strings(tags)
+	if len(tags) != 2 || tags[0] != "beta" || tags[1] != "release" {
+		t.Errorf("unexpected tags: %v", v.Tags)
+	}
+
+	if err := s.TagVersion(ctx, "a.txt", 2, "release"); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+	if err := s.TagVersion(ctx, "unknown.txt", 1, "release"); err == nil {
+		t.Errorf("expected an error for an unknown file")
+	}
+	if err := s.TagVersion(ctx, "a.txt", 1, ""); err == nil {
+		t.Errorf("expected an error for an empty tag")
+	}
+}
+
+func testGC(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	random := rand.New(rand.NewSource(2))
+	older := make([]byte, 128*1024)
+	random.Read(older)
+	newer := make([]byte, 128*1024)
+	random.Read(newer)
+
+	// a.txt has 6 versions with snapshots of versions 1 and 4, b.txt shares the snapshot of version 4
+	a, err := save(ctx, s, signature("a.txt", 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for size := int64(2); size <= 6; size++ {
+		sig := signature("a.txt", size)
+		sig.ID = a.ID
+		delta := &models.Delta{Ops: []models.Op{{Kind: models.OpLiteral, Length: 1, Data: []byte("x")}, {Kind: models.OpEnd}}, TargetLength: size}
+		if _, err := s.Update(ctx, &models.Version{Signature: sig, Delta: delta}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.SaveSnapshot(ctx, "a.txt", 1, bytes.NewReader(older)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "a.txt", 4, bytes.NewReader(newer)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.TagVersion(ctx, "a.txt", 2, "release"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := save(ctx, s, signature("b.txt", 0)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.SaveSnapshot(ctx, "b.txt", 1, bytes.NewReader(newer)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	numbers := func() []int {
+		versions, err := s.ListVersions(ctx, "a.txt")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var n []int
+		for _, v := range versions {
+			n = append(n, v.Number)
+		}
+		return n
+	}
+	stats := func() models.ChunkStats {
+		stats, err := s.ChunkStats(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return *stats
+	}
+
+	// versions 5 and 6 are restored from the snapshot of version 4, 1 to 3 can go
+	lastTwo := models.RetentionPolicy{KeepLast: 2}
+	before := stats()
+	report, err := s.GC(ctx, lastTwo, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := models.GCReport{DryRun: true, Files: 2, Versions: 3, Chunks: report.Chunks, ChunkBytes: int64(len(older)), DeltaBytes: 2}
+	if *report != want || report.Chunks == 0 {
+		t.Errorf("unexpected dry run report: got %+v, want %+v", report, want)
+	}
+	if got := numbers(); len(got) != 6 {
+		t.Errorf("dry run removed versions: %v", got)
+	}
+	if got := stats(); got != before {
+		t.Errorf("dry run modified the chunks: %+v, want %+v", got, before)
+	}
+
+	// the tagged version 2 is restored from the snapshot of version 1
+	report, err = s.GC(ctx, models.RetentionPolicy{KeepLast: 2, KeepTagged: true}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Versions != 1 || report.Chunks != 0 || report.DeltaBytes != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if got := numbers(); len(got) != 5 || got[2] != 4 {
+		t.Errorf("unexpected versions: got %v, want [1 2 4 5 6]", got)
+	}
+	if _, err := s.GetVersion(ctx, "a.txt", 3); err == nil {
+		t.Errorf("expected an error for a removed version")
+	}
+
+	report, err = s.GC(ctx, lastTwo, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Versions != 2 || report.ChunkBytes != int64(len(older)) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if got := numbers(); len(got) != 3 || got[0] != 4 {
+		t.Errorf("unexpected versions: got %v, want [4 5 6]", got)
+	}
+	// the snapshot shared with b.txt is kept once, with a reference from each file
+	if got := stats(); got.Bytes != int64(len(newer)) || got.LogicalBytes != 2*int64(len(newer)) {
+		t.Errorf("unexpected stats after the collection: %+v", got)
+	}
+	for path, n := range map[string]int{"a.txt": 4, "b.txt": 1} {
+		if v, err := s.GetVersion(ctx, path, n); err != nil || !bytes.Equal(v.Snapshot, newer) {
+			t.Errorf("unexpected snapshot of %s after the collection: %v", path, err)
+		}
+	}
+
+	// version numbers are not reused
+	sig := signature("a.txt", 7)
+	sig.ID = a.ID
+	if v, err := s.Update(ctx, &models.Version{Signature: sig}); err != nil || v.Number != 7 {
+		t.Errorf("unexpected version after the collection: %v, %v", v, err)
+	}
+}
+
+func testDelete(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(content)
+
+	// a.txt has 2 versions and a snapshot shared with b.txt
+	a, err := save(ctx, s, signature("a.txt", 16, "chunk 1", "chunk 2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated := signature("a.txt", 8, "chunk 1")
+	updated.ID = a.ID
+	if _, err := s.Update(ctx, &models.Version{Signature: updated}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.TagVersion(ctx, "a.txt", 2, "release"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := save(ctx, s, signature("b.txt", 8, "chunk 2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if err := s.SaveSnapshot(ctx, path, 1, bytes.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := s.DeleteByFilename(ctx, "a.txt"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists, err := s.FileExists(ctx, "a.txt"); err != nil || exists {
+		t.Errorf("unexpected result for a deleted file: %v, %v", exists, err)
+	}
+	if _, err := s.Get(ctx, a.ID); err == nil {
+		t.Errorf("expected an error for the signature of a deleted file")
+	}
+	if _, err := s.ListVersions(ctx, "a.txt"); err == nil {
+		t.Errorf("expected an error for the versions of a deleted file")
+	}
+	if exists, err := s.ChunkExists(ctx, updated.Chunks[0]); err != nil || exists {
+		t.Errorf("unexpected result for a chunk of a deleted file: %v, %v", exists, err)
+	}
+	if got, err := s.GetSignatureForChunk(ctx, b.Chunks[0]); err != nil || !sameSet(got, b) {
+		t.Errorf("unexpected signatures of a chunk of b.txt: got %+v, %v", got, err)
+	}
+	// the snapshot shared with b.txt is kept, with the reference of b.txt only
+	stats, err := s.ChunkStats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Bytes != int64(len(content)) || stats.LogicalBytes != int64(len(content)) {
+		t.Errorf("unexpected stats after deleting a.txt: %+v", stats)
+	}
+	if v, err := s.GetVersion(ctx, "b.txt", 1); err != nil || !bytes.Equal(v.Snapshot, content) {
+		t.Errorf("snapshot of b.txt was modified: %v", err)
+	}
+
+	if err := s.Delete(ctx, b.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists, err := s.FileExists(ctx, "b.txt"); err != nil || exists {
+		t.Errorf("unexpected result for a deleted file: %v, %v", exists, err)
+	}
+	if stats, err := s.ChunkStats(ctx); err != nil || *stats != (models.ChunkStats{}) {
+		t.Errorf("unexpected stats after deleting every file: %+v, %v", stats, err)
+	}
+
+	if err := s.Delete(ctx, b.ID); err == nil {
+		t.Errorf("expected an error for a deleted signature")
+	}
+	if err := s.DeleteByFilename(ctx, "a.txt"); err == nil {
+		t.Errorf("expected an error for a deleted file")
+	}
+
+	// a file saved again starts a new history
+	if _, err := save(ctx, s, signature("a.txt", 8)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if versions, err := s.ListVersions(ctx, "a.txt"); err != nil || len(versions) != 1 || versions[0].Number != 1 || versions[0].Tags != nil {
+		t.Errorf("unexpected versions of a file saved again: %v, %v", versions, err)
+	}
+}
+
+func testList(t *testing.T, s store.Storage) {
+	ctx := context.Background()
+
+	ids := make(map[string]uuid.UUID)
+	for _, path := range []string{"src/e.go", "docs/b.txt", "src/c.go", "docs/a.txt", "src/d.go"} {
+		saved, err := save(ctx, s, signature(path, 8))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids[path] = saved.ID
+	}
+	// the updated files are the most recently modified
+	for _, path := range []string{"docs/a.txt", "src/c.go"} {
+		sig := signature(path, 16)
+		sig.ID = ids[path]
+		if _, err := s.Update(ctx, &models.Version{Signature: sig}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// list returns the paths of all the pages of a listing
+	list := func(filter models.ListFilter, limit int) []string {
+		var paths []string
+		token := ""
+		for {
+			page, next, err := s.List(ctx, filter, token, limit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(page) > limit || (next != "" && len(page) != limit) {
+				t.Fatalf("unexpected page: %d files, next token %q", len(page), next)
+			}
+			for _, sig := range page {
+				paths = append(paths, sig.FilePath)
+			}
+			if next == "" {
+				return paths
+			}
+			token = next
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter models.ListFilter
+		limit  int
+		want   []string
+	}{
+		{"path", models.ListFilter{}, 10, []string{"docs/a.txt", "docs/b.txt", "src/c.go", "src/d.go", "src/e.go"}},
+		{"path pages", models.ListFilter{}, 2, []string{"docs/a.txt", "docs/b.txt", "src/c.go", "src/d.go", "src/e.go"}},
+		{"prefix", models.ListFilter{Prefix: "src/"}, 2, []string{"src/c.go", "src/d.go", "src/e.go"}},
+		{"no match", models.ListFilter{Prefix: "test/"}, 2, nil},
+		{"modified", models.ListFilter{OrderBy: models.OrderByModified}, 2, []string{"src/c.go", "docs/a.txt", "src/d.go", "docs/b.txt", "src/e.go"}},
+		{"modified prefix", models.ListFilter{Prefix: "docs/", OrderBy: models.OrderByModified}, 1, []string{"docs/a.txt", "docs/b.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := list(tt.filter, tt.limit)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("unexpected files: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the current signatures are listed
+	page, _, err := s.List(ctx, models.ListFilter{Prefix: "docs/a"}, "", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page) != 1 || page[0].ID != ids["docs/a.txt"] || page[0].FileSize != 16 {
+		t.Errorf("unexpected signatures: %+v", page)
+	}
+
+	// a page token stays valid when files are deleted
+	page, token, err := s.List(ctx, models.ListFilter{}, "", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.DeleteByFilename(ctx, "src/c.go"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	page, _, err = s.List(ctx, models.ListFilter{}, token, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page) != 2 || page[0].FilePath != "src/d.go" || page[1].FilePath != "src/e.go" {
+		t.Errorf("unexpected page after a deletion: %+v", page)
+	}
+
+	if _, _, err := s.List(ctx, models.ListFilter{}, "", 0); err == nil {
+		t.Errorf("expected an error for an invalid limit")
+	}
+	if _, _, err := s.List(ctx, models.ListFilter{}, "not a token", 2); err == nil {
+		t.Errorf("expected an error for an invalid page token")
+	}
+	if _, _, err := s.List(ctx, models.ListFilter{OrderBy: models.OrderByModified}, token, 2); err == nil {
+		t.Errorf("expected an error for a page token of another order")
+	}
+}
@@ -1,61 +1,84 @@
 package tests
 
 import (
+	"context"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
 
 	"github.com/hungaikev/rdiff/internal/pkg/apply"
 	"github.com/hungaikev/rdiff/internal/pkg/diff"
 	"github.com/hungaikev/rdiff/internal/pkg/fileio"
 	"github.com/hungaikev/rdiff/internal/pkg/signature"
+	"github.com/hungaikev/rdiff/internal/shared/models"
+	"github.com/hungaikev/rdiff/internal/store/memory"
 )
 
 func TestEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+	tracer := otel.Tracer("tests")
 
-	tmpOriginal, err := fileio.OpenFile("testdata/tmp-original.txt")
+	// work on a copy of the original file, apply rewrites it in place
+	b, err := ioutil.ReadFile("testdata/tmp-original.txt")
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	originalPath := filepath.Join(t.TempDir(), "tmp-original.txt")
+	if err := ioutil.WriteFile(originalPath, b, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tmpOriginal, err := fileio.OpenFile(ctx, originalPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	defer tmpOriginal.Close()
 
-	// generate signature for original file
-	original, err := signature.GenerateSignature(tmpOriginal)
+	// generate signature for original file and store it
+	storage := memory.New(&log, tracer)
+	original, err := signature.Generate(ctx, tmpOriginal, &log)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := storage.Save(ctx, &models.Version{Signature: original}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	tmpUpdated, err := fileio.OpenFile("testdata/tmp-updated.txt")
+	tmpUpdated, err := fileio.OpenFile(ctx, "testdata/tmp-updated.txt")
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	defer tmpUpdated.Close()
 
-	// generate signature for updated file
-	updated, err := signature.GenerateSignature(tmpUpdated)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
-	}
-
 	// compute delta
-	delta, err := diff.Diff(original, updated)
+	delta, err := diff.Compare(ctx, original, tmpUpdated)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	// apply delta to original file
-	if err := apply.Apply(tmpOriginal.Name(), delta); err != nil {
-		t.Errorf("un	expected error: %v", err)
+	if _, err := apply.New(delta, storage, &log, tracer).Changes(ctx, original); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	// check if original file has been updated
-	b, err := ioutil.ReadFile(tmpOriginal.Name())
+	b, err = ioutil.ReadFile(originalPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/tmp-updated.txt")
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
 	assert.Contains(t, string(b), "updated")
+	assert.Equal(t, string(expected), string(b))
 }